@@ -7,6 +7,7 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/template/html"
 	"github.com/rayuruno/ltirun/lti"
+	"github.com/rayuruno/ltirun/run"
 	"github.com/valyala/fastjson"
 )
 
@@ -26,6 +27,11 @@ func New(views *html.Engine, hostname string) *fiber.App {
 		})
 	}
 
+	// domain verification for the example providers
+	app.Get("/:provider/.well-known/ltirun-challenge", func(c *fiber.Ctx) error {
+		return c.SendString(run.DomainChallenge(c.Hostname() + prefix + "/" + c.Params("provider")))
+	})
+
 	app.Post("/provider/lti/launch", func(c *fiber.Ctx) error {
 		token := strings.TrimPrefix(c.Get("Authorization"), "Bearer ")
 		if token == "" {
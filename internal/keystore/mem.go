@@ -6,9 +6,12 @@ import (
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base32"
+	"encoding/base64"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/MicahParks/jwkset"
@@ -17,14 +20,17 @@ import (
 )
 
 type keyStore struct {
-	ctx context.Context
-	set jwkset.JWKSet[any]
+	ctx  context.Context
+	set  jwkset.JWKSet[any]
+	mu   sync.Mutex
+	kids map[string]string
 }
 
 func New() *keyStore {
 	return &keyStore{
-		set: jwkset.NewMemory[any](),
-		ctx: context.Background(),
+		set:  jwkset.NewMemory[any](),
+		ctx:  context.Background(),
+		kids: make(map[string]string),
 	}
 }
 func (s *keyStore) Jwks(id string) ([]byte, error) {
@@ -41,7 +47,29 @@ func (s *keyStore) Sign(claims jwt.Claims, id string) (string, error) {
 	t.Header["alg"] = signingKey.ALG.String()
 	return t.SignedString(signingKey.Key)
 }
+
+// Rotate revokes the key of id, its public key leaves Jwks and the next signature uses a
+// new key.
+func (s *keyStore) Rotate(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kid, ok := s.kids[id]
+	if !ok {
+		return nil
+	}
+	delete(s.kids, id)
+	_, err := s.set.Store.DeleteKey(s.ctx, kid)
+	return err
+}
+
+// signingKey returns the key id signs with, it is generated on first use and kept until
+// Rotate. Keys live in process memory only, a restart or another instance signs with a
+// new key, every key stays published at Jwks until Rotate. The key is generated
+// outside the lock so a new consumer does not hold up the signatures of the others.
 func (s *keyStore) signingKey(id string) (*jwkset.KeyWithMeta[any], error) {
+	if key, ok := s.cachedKey(id); ok {
+		return key, nil
+	}
 	key, err := rsa.GenerateKey(rand.Reader, 4096)
 	if err != nil {
 		return nil, err
@@ -52,12 +80,36 @@ func (s *keyStore) signingKey(id string) (*jwkset.KeyWithMeta[any], error) {
 	}
 	pkey := jwkset.NewKey[any](key, kid)
 	pkey.ALG = "RS256"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// another signature of id generated a key meanwhile
+	if key, ok := s.readKey(id); ok {
+		return key, nil
+	}
 	err = s.set.Store.WriteKey(s.ctx, pkey)
 	if err != nil {
 		return nil, err
 	}
+	s.kids[id] = kid
 	return &pkey, nil
 }
+func (s *keyStore) cachedKey(id string) (*jwkset.KeyWithMeta[any], bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readKey(id)
+}
+func (s *keyStore) readKey(id string) (*jwkset.KeyWithMeta[any], bool) {
+	kid, ok := s.kids[id]
+	if !ok {
+		return nil, false
+	}
+	key, err := s.set.Store.ReadKey(s.ctx, kid)
+	if err != nil {
+		return nil, false
+	}
+	return &key, true
+}
 func (*keyStore) Verify(signed string, jwksUri string) (*jwt.Token, error) {
 	jwks, err := keyfunc.Get(jwksUri, keyfunc.Options{})
 	if err != nil {
@@ -71,6 +123,37 @@ func (*keyStore) Verify(signed string, jwksUri string) (*jwt.Token, error) {
 	}
 	return token, nil
 }
+func (*keyStore) VerifyKey(signed string, jwksUri string) (*jwt.Token, string, error) {
+	jwks, err := keyfunc.Get(jwksUri, keyfunc.Options{})
+	if err != nil {
+		return nil, "", err
+	}
+	thumbprint := ""
+	token, err := jwt.Parse(signed, func(t *jwt.Token) (any, error) {
+		key, err := jwks.Keyfunc(t)
+		if err != nil {
+			return nil, err
+		}
+		thumbprint, err = keyThumbprint(key)
+		return key, err
+	}, jwt.WithTimeFunc(func() time.Time {
+		return time.Now().UTC().Add(time.Second * 20)
+	}))
+	if err != nil {
+		return nil, "", err
+	}
+	return token, thumbprint, nil
+}
+
+// keyThumbprint is the SHA-256 of the public key's SubjectPublicKeyInfo.
+func keyThumbprint(key any) (string, error) {
+	b, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
 func publicKeyId(key *rsa.PrivateKey) (string, error) {
 	b, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
 	if err != nil {
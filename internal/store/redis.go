@@ -0,0 +1,37 @@
+package store
+
+import (
+	"context"
+	"strings"
+
+	"github.com/gofiber/storage/redis/v2"
+)
+
+type redisStore struct {
+	*redis.Storage
+}
+
+func NewRedis(config redis.Config) *redisStore {
+	return &redisStore{redis.New(config)}
+}
+
+// Keys scans the keys starting with prefix.
+func (s *redisStore) Keys(prefix string) ([]string, error) {
+	ctx := context.Background()
+	match := globEscaper.Replace(prefix) + "*"
+	var keys []string
+	var cursor uint64
+	for {
+		ks, next, err := s.Conn().Scan(ctx, cursor, match, 100).Result()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, ks...)
+		if next == 0 {
+			return keys, nil
+		}
+		cursor = next
+	}
+}
+
+var globEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
@@ -0,0 +1,46 @@
+package lti
+
+// https://canvas.instructure.com/doc/api/file.lti_dev_key_config.html
+type CanvasConfig struct {
+	Title             string            `json:"title"`
+	Description       string            `json:"description"`
+	OidcInitiationUrl string            `json:"oidc_initiation_url"`
+	TargetLinkUri     string            `json:"target_link_uri"`
+	PublicJwkUrl      string            `json:"public_jwk_url"`
+	Scopes            []string          `json:"scopes"`
+	Extensions        []CanvasExtension `json:"extensions"`
+	CustomFields      map[string]string `json:"custom_fields,omitempty"`
+}
+
+type CanvasExtension struct {
+	Domain       string         `json:"domain"`
+	ToolId       string         `json:"tool_id"`
+	Platform     string         `json:"platform"`
+	PrivacyLevel string         `json:"privacy_level"`
+	Settings     CanvasSettings `json:"settings"`
+}
+
+type CanvasSettings struct {
+	Text       string            `json:"text"`
+	IconUrl    string            `json:"icon_url,omitempty"`
+	Placements []CanvasPlacement `json:"placements"`
+}
+
+type CanvasPlacement struct {
+	Placement     string `json:"placement"`
+	MessageType   string `json:"message_type"`
+	TargetLinkUri string `json:"target_link_uri"`
+	Text          string `json:"text,omitempty"`
+	IconUrl       string `json:"icon_url,omitempty"`
+}
+
+// CanvasPlatform is the platform configuration shared by hosted Canvas instances.
+func CanvasPlatform() *Platform {
+	return &Platform{
+		Issuer:                "https://canvas.instructure.com",
+		AuthorizationEndpoint: "https://sso.canvaslms.com/api/lti/authorize_redirect",
+		TokenEndpoint:         "https://sso.canvaslms.com/login/oauth2/token",
+		JwksUri:               "https://sso.canvaslms.com/api/lti/security/jwks",
+		LtiPlatform:           LtiPlatform{ProductFamilyCode: "canvas"},
+	}
+}
@@ -0,0 +1,96 @@
+package lti
+
+import "encoding/xml"
+
+// https://www.imsglobal.org/cc/ccv1p3/imscc_Overview-v1p3.html
+type CartridgeManifest struct {
+	XMLName       xml.Name                `xml:"manifest"`
+	Identifier    string                  `xml:"identifier,attr"`
+	Xmlns         string                  `xml:"xmlns,attr"`
+	Metadata      CartridgeMetadata       `xml:"metadata"`
+	Organizations []CartridgeOrganization `xml:"organizations>organization"`
+	Resources     []CartridgeResource     `xml:"resources>resource"`
+}
+
+type CartridgeMetadata struct {
+	Schema        string `xml:"schema"`
+	SchemaVersion string `xml:"schemaversion"`
+}
+
+type CartridgeOrganization struct {
+	Identifier string        `xml:"identifier,attr"`
+	Structure  string        `xml:"structure,attr"`
+	Item       CartridgeItem `xml:"item"`
+}
+
+type CartridgeItem struct {
+	Identifier    string          `xml:"identifier,attr"`
+	IdentifierRef string          `xml:"identifierref,attr,omitempty"`
+	Title         string          `xml:"title,omitempty"`
+	Items         []CartridgeItem `xml:"item,omitempty"`
+}
+
+type CartridgeResource struct {
+	Identifier string `xml:"identifier,attr"`
+	Type       string `xml:"type,attr"`
+	File       struct {
+		Href string `xml:"href,attr"`
+	} `xml:"file"`
+}
+
+// https://www.imsglobal.org/specs/ltiv1p0/implementation-guide#toc-7
+type BasicLtiLink struct {
+	XMLName         xml.Name       `xml:"cartridge_basiclti_link"`
+	Xmlns           string         `xml:"xmlns,attr"`
+	XmlnsBlti       string         `xml:"xmlns:blti,attr"`
+	XmlnsLticm      string         `xml:"xmlns:lticm,attr"`
+	XmlnsLticp      string         `xml:"xmlns:lticp,attr"`
+	Title           string         `xml:"blti:title"`
+	Description     string         `xml:"blti:description,omitempty"`
+	Custom          *LtiProperties `xml:"blti:custom,omitempty"`
+	Extensions      LtiExtensions  `xml:"blti:extensions"`
+	LaunchUrl       string         `xml:"blti:launch_url"`
+	SecureLaunchUrl string         `xml:"blti:secure_launch_url"`
+	Icon            string         `xml:"blti:icon,omitempty"`
+	Vendor          LtiVendor      `xml:"blti:vendor"`
+}
+
+type LtiProperties struct {
+	Properties []LtiProperty `xml:"lticm:property"`
+}
+
+type LtiExtensions struct {
+	Platform   string        `xml:"platform,attr"`
+	Properties []LtiProperty `xml:"lticm:property"`
+}
+
+type LtiProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+type LtiVendor struct {
+	Code string `xml:"lticp:code"`
+	Name string `xml:"lticp:name"`
+	Url  string `xml:"lticp:url,omitempty"`
+}
+
+func NewBasicLtiLink() *BasicLtiLink {
+	return &BasicLtiLink{
+		Xmlns:      "http://www.imsglobal.org/xsd/imslticc_v1p3",
+		XmlnsBlti:  "http://www.imsglobal.org/xsd/imsbasiclti_v1p0",
+		XmlnsLticm: "http://www.imsglobal.org/xsd/imslticm_v1p0",
+		XmlnsLticp: "http://www.imsglobal.org/xsd/imslticp_v1p0",
+	}
+}
+
+func NewCartridgeManifest(id string) *CartridgeManifest {
+	return &CartridgeManifest{
+		Identifier: id,
+		Xmlns:      "http://www.imsglobal.org/xsd/imsccv1p3/imscp_v1p1",
+		Metadata: CartridgeMetadata{
+			Schema:        "IMS Common Cartridge",
+			SchemaVersion: "1.3.0",
+		},
+	}
+}
@@ -2,6 +2,8 @@ package lti
 
 import (
 	"encoding/json"
+	"strconv"
+	"time"
 
 	"github.com/google/go-querystring/query"
 )
@@ -13,7 +15,9 @@ type LoginInit struct {
 	TargetLinkUri  string `form:"target_link_uri" query:"target_link_uri"`
 	LtiMessageHint string `form:"lti_message_hint" query:"lti_message_hint"`
 	ClientId       string `form:"client_id" query:"client_id"`
-	DeploymentId   string `form:"lti_deployment_id" query:"lti_deployment_id"` //bug, with or without lti?
+	DeploymentId   string `form:"lti_deployment_id" query:"lti_deployment_id"`
+	// LegacyDeploymentId is sent by some platforms instead of lti_deployment_id
+	LegacyDeploymentId string `form:"deployment_id" query:"deployment_id"`
 }
 
 // https://imsglobal.org/spec/security/v1p0/#step-2-authentication-request
@@ -27,7 +31,7 @@ type AuthenticateRequest struct {
 	State          string `url:"state"`
 	ResponseMode   string `url:"response_mode"`
 	Nonce          string `url:"nonce"`
-	Prompt         string `url:"prompt"`
+	Prompt         string `url:"prompt,omitempty"`
 }
 
 func (a *AuthenticateRequest) Encode() (string, error) {
@@ -51,6 +55,22 @@ type AccessToken struct {
 	Scope     string `json:"scope"`
 }
 
+// ExpiresAfter returns the expires_in lifetime, platforms send it either as number or string.
+func (t *AccessToken) ExpiresAfter() time.Duration {
+	switch v := t.ExpiresIn.(type) {
+	case float64:
+		return time.Duration(v) * time.Second
+	case string:
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0
+		}
+		return time.Duration(n) * time.Second
+	default:
+		return 0
+	}
+}
+
 type ServiceRequest struct {
 	Scope       string          `json:"scope"`
 	Method      string          `json:"method"`
@@ -58,4 +78,15 @@ type ServiceRequest struct {
 	Accept      string          `json:"accept"`
 	Endpoint    string          `json:"endpoint"`
 	Body        json.RawMessage `json:"body"`
+	Async       bool            `json:"async,omitempty"`
+	Callback    string          `json:"callback,omitempty"`
+}
+
+type ProviderServiceRequest struct {
+	Iss            string `json:"iss,omitempty"`
+	ClientId       string `json:"client_id,omitempty"`
+	DeploymentId   string `json:"deployment_id,omitempty"`
+	ContextId      string `json:"context_id,omitempty"`
+	ResourceLinkId string `json:"resource_link_id,omitempty"`
+	ServiceRequest
 }
@@ -63,8 +63,39 @@ func (c *Platform) Validate(drUrl string) error {
 		return fmt.Errorf("id_token_signing_alg_values_supported must contain RS256")
 	}
 	// dynamic only
-	if drUrl != "" && !strings.HasPrefix(drUrl, c.Issuer) {
-		return fmt.Errorf("invalid platform")
+	if drUrl != "" && drUrl != c.Issuer && !strings.HasPrefix(drUrl, strings.TrimSuffix(c.Issuer, "/")+"/") {
+		return fmt.Errorf("issuer %s does not match openid_configuration %s", c.Issuer, drUrl)
+	}
+	return nil
+}
+
+// ValidateMessages checks the tool messages against messages_supported, when the platform lists them.
+func (c *Platform) ValidateMessages(ms []LtiMessage) error {
+	if len(c.MessagesSupported) == 0 {
+		return nil
+	}
+	for _, m := range ms {
+		supported := c.messageSupported(m.Type)
+		if supported == nil {
+			return fmt.Errorf("message %s not supported by platform", m.Type)
+		}
+		if len(supported.Placements) == 0 {
+			continue
+		}
+		for _, p := range m.Placements {
+			if !check.ContainsAny(supported.Placements, p) {
+				return fmt.Errorf("placement %s of message %s not supported by platform", p, m.Type)
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Platform) messageSupported(mtype string) *MessageSupported {
+	for i, m := range c.MessagesSupported {
+		if m.Type == mtype {
+			return &c.MessagesSupported[i]
+		}
 	}
 	return nil
 }
@@ -41,6 +41,7 @@ type Tool struct {
 	InitiateLoginUri             string          `json:"initiate_login_uri,omitempty"`
 	RequestUris                  []string        `json:"request_uris,omitempty"`
 	Scope                        string          `json:"scope"`
+	SoftwareStatement            string          `json:"software_statement,omitempty"`
 	LtiTool                      `json:"https://purl.imsglobal.org/spec/lti-tool-configuration"`
 }
 
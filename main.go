@@ -2,11 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"embed"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/filesystem"
@@ -14,6 +16,7 @@ import (
 	"github.com/gofiber/template/html"
 	"github.com/rayuruno/ltirun/examples"
 	"github.com/rayuruno/ltirun/internal/keystore"
+	"github.com/rayuruno/ltirun/internal/store"
 	"github.com/rayuruno/ltirun/lti"
 	"github.com/rayuruno/ltirun/run"
 	"github.com/rs/zerolog"
@@ -25,6 +28,8 @@ import (
 var (
 	redisUrl     = env.Fetch("REDIS_URL", "redis://localhost:6379")
 	examplesHost = env.Fetch("EXAMPLES_HOST", "")
+	// comma separated providers allowed over http and without a dotted host, development only
+	devProviders = env.Fetch("DEV_PROVIDERS", "")
 )
 
 //go:embed views
@@ -38,7 +43,16 @@ func main() {
 	zerolog.ErrorStackMarshaler = pkgerrors.MarshalStack
 	zerolog.SetGlobalLevel(zerolog.DebugLevel)
 
-	api := run.New(redis.New(redis.Config{URL: redisUrl}), keystore.New())
+	if devProviders != "" {
+		providers := strings.Split(devProviders, ",")
+		for i := range providers {
+			providers[i] = strings.TrimSpace(providers[i])
+		}
+		run.DevProviders(providers...)
+		log.Warn().Strs("providers", providers).Msg("DEV MODE: http and dotless hosts allowed for these providers, never enable in production")
+	}
+
+	api := run.New(store.NewRedis(redis.Config{URL: redisUrl}), keystore.New())
 	views := html.NewFileSystem(http.FS(viewsFS), ".html")
 	app := fiber.New(fiber.Config{
 		Views:        views,
@@ -61,6 +75,9 @@ func main() {
 		check(err)
 		return c.Send(b)
 	}))
+	app.Get("/diagnostics/*", recoverable(func(c *fiber.Ctx) error {
+		return c.JSON(api.DiagnoseToolConfig(c.BaseURL(), c.Params("*")))
+	}))
 	app.Get("/jwks/*", recoverable(func(c *fiber.Ctx) error {
 		c.Set("Content-Type", "application/json")
 		jwks, err := api.JsonWebKeys(c.Params("*"))
@@ -68,21 +85,43 @@ func main() {
 		return c.Send(jwks)
 	}))
 	app.Get("/register/*", recoverable(func(c *fiber.Ctx) error {
+		return renderRegister(c, api, new(lti.Platform), c.BaseURL()+"/openid_configuration/"+c.Params("*"))
+	}))
+	app.Get("/canvas/*", recoverable(func(c *fiber.Ctx) error {
 		providerUri := c.Params("*")
-		t := new(lti.Tool)
-		err := api.LoadToolConfig(c.BaseURL(), providerUri, t)
-		errMsg := ""
-		if err != nil {
-			errMsg = err.Error()
+		if strings.HasSuffix(providerUri, ".json") {
+			cc := new(lti.CanvasConfig)
+			check(api.CanvasConfig(c.BaseURL(), strings.TrimSuffix(providerUri, ".json"), cc))
+			return c.JSON(cc)
 		}
-		return c.Render("views/register", fiber.Map{
-			"Platform": new(lti.Platform),
-			"Tool":     t,
-			"Link":     c.BaseURL() + "/openid_configuration/" + providerUri,
-			"Error":    errMsg,
-		}, "views/layout")
+		return renderRegister(c, api, lti.CanvasPlatform(), c.BaseURL()+"/canvas/"+providerUri+".json")
 	}))
-	app.Post("/register/*", recoverable(func(c *fiber.Ctx) error {
+	app.Get("/cartridge/*", recoverable(func(c *fiber.Ctx) error {
+		providerUri := c.Params("*")
+		switch {
+		case strings.HasSuffix(providerUri, ".imscc"):
+			providerUri = strings.TrimSuffix(providerUri, ".imscc")
+			var b bytes.Buffer
+			check(api.WriteCartridge(c.BaseURL(), providerUri, &b))
+			c.Set("Content-Type", "application/zip")
+			c.Attachment(hostname(providerUri) + ".imscc")
+			return c.Send(b.Bytes())
+		case strings.HasSuffix(providerUri, ".xml"):
+			links, err := api.CartridgeLinks(c.BaseURL(), strings.TrimSuffix(providerUri, ".xml"))
+			check(err)
+			i := c.QueryInt("message")
+			if i < 0 || i >= len(links) {
+				return fiber.ErrNotFound
+			}
+			b, err := run.MarshalXML(links[i])
+			check(err)
+			c.Set("Content-Type", fiber.MIMEApplicationXMLCharsetUTF8)
+			return c.Send(b)
+		default:
+			return fiber.ErrNotFound
+		}
+	}))
+	register := recoverable(func(c *fiber.Ctx) error {
 		providerUri := c.Params("*")
 		p := new(lti.Platform)
 		t := new(lti.Tool)
@@ -92,40 +131,97 @@ func main() {
 		p.JwksUri = c.FormValue("jwks_uri")
 		p.TokenEndpoint = c.FormValue("token_endpoint")
 		p.AuthorizationEndpoint = c.FormValue("authorization_endpoint")
+		p.ProductFamilyCode = c.FormValue("product_family_code")
 		t.DeploymentId = c.FormValue("deployment_id")
 		r.Tool = t
 		r.ClientId = c.FormValue("client_id")
-		err := api.StoreRegistration(providerUri, p, r)
+		var err error
+		var diff []run.RegistrationDiff
+		if c.FormValue("action") == "prefill" {
+			err = api.PrefillPlatform(c.FormValue("openid_configuration"), p.Issuer, p)
+			diff = api.DiffRegistration(providerUri, p, r.ClientId, r.DeploymentId)
+		} else {
+			err = api.StoreRegistration(providerUri, p, r, t, nil)
+		}
+		var rejected *run.PolicyError
+		if errors.As(err, &rejected) {
+			return renderError(c, "Registration rejected", err)
+		}
 		errMsg := ""
 		if err != nil {
 			errMsg = err.Error()
 		}
 		return c.Render("views/register", fiber.Map{
 			"Platform":     p,
+			"ConfigUrl":    c.FormValue("openid_configuration"),
 			"ClientId":     r.ClientId,
 			"DeploymentId": r.DeploymentId,
 			"Tool":         r.Tool,
 			"Link":         c.BaseURL() + "/openid_configuration/" + providerUri,
+			"Diff":         diff,
+			"Profiles":     run.ProfileNames(),
 			"Error":        errMsg,
 		}, "views/layout")
-	}))
+	})
+	app.Post("/register/*", register)
+	app.Post("/canvas/*", register)
 	app.All("/connect/*", recoverable(func(c *fiber.Ctx) error {
 		providerUri := c.Params("*")
 		i := new(lti.RegistrationInit)
-		p := new(lti.Platform)
-		t := new(lti.Tool)
-		r := new(lti.Registration)
 		check(anyParser(c, i))
-		check(api.GetPlatformConfig(i.Endpoint, i.Token, p))
-		check(api.LoadToolConfig(c.BaseURL(), providerUri, t))
-		check(api.PostToolConfig(p.RegistrationEndpoint, i.Token, t, r))
-		check(api.StoreRegistration(providerUri, p, r))
+		pc, err := api.BeginConnect(c.BaseURL(), providerUri, i)
+		if err != nil {
+			return renderError(c, "Registration failed", err)
+		}
+		return c.Render("views/connect", fiber.Map{
+			"Id":       pc.Id,
+			"Provider": providerUri,
+			"Platform": pc.Platform,
+			"Tool":     pc.Tool,
+			"Scopes":   strings.Fields(pc.Tool.Scope),
+		}, "views/layout")
+	}))
+	app.Post("/confirm/*", recoverable(func(c *fiber.Ctx) error {
+		cc := new(run.ConnectConfirm)
+		check(c.BodyParser(cc))
+		if err := api.FinishConnect(c.Params("*"), cc); err != nil {
+			return renderError(c, "Registration failed", err)
+		}
 		return c.Render("views/closer", nil)
 	}))
+	app.All("/verify/*", recoverable(func(c *fiber.Ctx) error {
+		providerUri := c.Params("*")
+		errMsg := ""
+		if c.Method() == fiber.MethodPost {
+			if err := api.VerifyDomain(providerUri); err != nil {
+				errMsg = err.Error()
+			}
+		}
+		return c.Render("views/verify", fiber.Map{
+			"Provider":     providerUri,
+			"ChallengeUrl": run.ChallengeUrl(providerUri),
+			"Challenge":    run.DomainChallenge(providerUri),
+			"Verified":     api.DomainVerified(providerUri),
+			"Error":        errMsg,
+		}, "views/layout")
+	}))
 	app.All("/login/*", recoverable(func(c *fiber.Ctx) error {
 		i := new(lti.LoginInit)
 		check(anyParser(c, i))
 		location, err := api.Authn(c.Params("*"), i)
+		var ambiguous *run.AmbiguousLoginError
+		if errors.As(err, &ambiguous) {
+			log.Error().Err(err).Str("path", c.Path()).Msg("Ambiguous login")
+			return c.Status(fiber.StatusBadRequest).Render("views/error", fiber.Map{
+				"Title":         "Ambiguous login",
+				"Error":         err.Error(),
+				"Registrations": ambiguous.Matches,
+			}, "views/layout")
+		}
+		var rejected *run.PolicyError
+		if errors.As(err, &rejected) {
+			return renderError(c, "Launch rejected", err)
+		}
 		check(err)
 		return c.Redirect(location)
 	}))
@@ -133,35 +229,53 @@ func main() {
 		a := new(lti.AuthenticateResponse)
 		check(anyParser(c, a))
 		s, err := api.Authz(c.Params("*"), a)
+		var rejected *run.PolicyError
+		if errors.As(err, &rejected) {
+			return renderError(c, "Launch rejected", err)
+		}
 		check(err)
 		b := ""
 		check(api.Launch(s, &b))
 		c.Set("Content-Type", fiber.MIMETextHTMLCharsetUTF8)
 		return c.SendString(b)
 	}))
+	preflight := func(c *fiber.Ctx) error {
+		origin := c.Get("Origin")
+		if !api.CorsOrigin(c.Params("*"), origin) {
+			return fiber.ErrForbidden
+		}
+		c.Set("Access-Control-Allow-Origin", origin)
+		c.Set("Access-Control-Allow-Methods", "POST")
+		c.Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		c.Set("Vary", "Origin")
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+	app.Options("/service/*", preflight)
+	app.Options("/jwt/*", preflight)
 	app.Post("/service/*", recoverable(func(c *fiber.Ctx) error {
 		log.Debug().Any("head", c.GetReqHeaders()).Msg("service")
-		if string(c.Context().Referer()) != c.BaseURL()+"/launch/"+c.Params("*") {
-			return fiber.ErrUnauthorized
-		}
-		if c.Get("Sec-Fetch-Site") != "same-origin" {
-			return fiber.ErrUnauthorized
+		if err := checkBrowser(c, api); err != nil {
+			return err
 		}
 		sr := new(lti.ServiceRequest)
 		a := new(lti.AccessToken)
 		check(anyParser(c, sr))
 		s, err := api.GetSession(jwksUri(c), bearer(c))
 		check(err)
+		check(api.CheckServiceRequest(s, sr))
+		if sr.Async {
+			o, err := api.EnqueueScore(c.Params("*"), s, sr)
+			check(err)
+			return c.Status(fiber.StatusAccepted).JSON(o.Summary())
+		}
 		check(api.GetAccessToken(s, sr, a))
-		check(api.SendServiceRequest(a, sr))
-		return c.SendStatus(200)
+		b := ""
+		check(api.SendServiceRequest(a, sr, &b))
+		return c.SendString(b)
 	}))
 	app.Post("/jwt/*", recoverable(func(c *fiber.Ctx) error {
-		if string(c.Context().Referer()) != c.BaseURL()+"/launch/"+c.Params("*") {
-			return fiber.ErrUnauthorized
-		}
-		if c.Get("Sec-Fetch-Site") != "same-origin" {
-			return fiber.ErrUnauthorized
+		if err := checkBrowser(c, api); err != nil {
+			return err
 		}
 		s, err := api.GetSession(jwksUri(c), bearer(c))
 		check(err)
@@ -169,6 +283,98 @@ func main() {
 		check(err)
 		return c.SendString(j)
 	}))
+	app.Post("/api/service/*", recoverable(func(c *fiber.Ctx) error {
+		providerUri := c.Params("*")
+		if err := authProvider(c, api); err != nil {
+			return err
+		}
+		pr := new(lti.ProviderServiceRequest)
+		a := new(lti.AccessToken)
+		check(c.BodyParser(pr))
+		s, err := api.GetContextSession(providerUri, pr)
+		check(err)
+		check(api.CheckServiceRequest(s, &pr.ServiceRequest))
+		if pr.Async {
+			o, err := api.EnqueueScore(providerUri, s, &pr.ServiceRequest)
+			check(err)
+			return c.Status(fiber.StatusAccepted).JSON(o.Summary())
+		}
+		check(api.GetAccessToken(s, &pr.ServiceRequest, a))
+		b := ""
+		check(api.SendServiceRequest(a, &pr.ServiceRequest, &b))
+		return c.SendString(b)
+	}))
+	app.Get("/api/outbox/*", recoverable(func(c *fiber.Ctx) error {
+		if err := authProvider(c, api); err != nil {
+			return err
+		}
+		o, err := api.GetOutboxItem(c.Params("*"), c.Query("id"))
+		check(err)
+		return c.JSON(o.Summary())
+	}))
+	app.Get("/api/settings/*", recoverable(func(c *fiber.Ctx) error {
+		if err := authProvider(c, api); err != nil {
+			return err
+		}
+		return c.JSON(api.GetSettings(c.Params("*")))
+	}))
+	app.Put("/api/settings/*", recoverable(func(c *fiber.Ctx) error {
+		if err := authProvider(c, api); err != nil {
+			return err
+		}
+		s := new(run.Settings)
+		check(c.BodyParser(s))
+		check(api.StoreSettings(c.Params("*"), s))
+		return c.JSON(s)
+	}))
+	app.Get("/api/audit/*", recoverable(func(c *fiber.Ctx) error {
+		if err := authProvider(c, api); err != nil {
+			return err
+		}
+		return c.JSON(api.AuditLog(c.Params("*")))
+	}))
+	app.Get("/api/updates/*", recoverable(func(c *fiber.Ctx) error {
+		if err := authProvider(c, api); err != nil {
+			return err
+		}
+		return c.JSON(api.RegistrationUpdates(c.Params("*")))
+	}))
+	app.Post("/api/updates/*", recoverable(func(c *fiber.Ctx) error {
+		if err := authProvider(c, api); err != nil {
+			return err
+		}
+		updates, err := api.UpdateRegistrations(c.BaseURL(), c.Params("*"))
+		check(err)
+		return c.JSON(updates)
+	}))
+	app.Get("/api/registrations/*", recoverable(func(c *fiber.Ctx) error {
+		if err := authProvider(c, api); err != nil {
+			return err
+		}
+		if id := c.Query("id"); id != "" {
+			d, err := api.GetConsumer(c.Params("*"), id)
+			check(err)
+			return c.JSON(d)
+		}
+		return c.JSON(api.ListConsumers(c.Params("*")))
+	}))
+	app.Post("/api/registrations/*", recoverable(func(c *fiber.Ctx) error {
+		if err := authProvider(c, api); err != nil {
+			return err
+		}
+		a := new(run.ConsumerAction)
+		check(c.BodyParser(a))
+		s, err := api.UpdateConsumer(c.Params("*"), a)
+		check(err)
+		return c.JSON(s)
+	}))
+	app.Delete("/api/registrations/*", recoverable(func(c *fiber.Ctx) error {
+		if err := authProvider(c, api); err != nil {
+			return err
+		}
+		check(api.DeleteConsumer(c.Params("*"), c.Query("id")))
+		return c.SendStatus(fiber.StatusNoContent)
+	}))
 
 	if examplesHost != "" {
 		app.Mount("/", examples.New(views, examplesHost))
@@ -176,6 +382,8 @@ func main() {
 		app.Mount("/examples", examples.New(views, examplesHost))
 	}
 
+	go api.RunOutbox(context.Background(), time.Second*10)
+
 	app.Listen(":8080")
 }
 
@@ -216,6 +424,30 @@ func errorHandler(c *fiber.Ctx, err error) error {
 	return c.Status(code).SendString(err.Error())
 }
 
+func renderRegister(c *fiber.Ctx, api *run.Api, p *lti.Platform, link string) error {
+	t := new(lti.Tool)
+	err := api.LoadToolConfig(c.BaseURL(), c.Params("*"), t)
+	errMsg := ""
+	if err != nil {
+		errMsg = err.Error()
+	}
+	return c.Render("views/register", fiber.Map{
+		"Platform": p,
+		"Tool":     t,
+		"Link":     link,
+		"Profiles": run.ProfileNames(),
+		"Error":    errMsg,
+	}, "views/layout")
+}
+
+func renderError(c *fiber.Ctx, title string, err error) error {
+	log.Error().Err(err).Str("path", c.Path()).Msg(title)
+	return c.Status(fiber.StatusBadRequest).Render("views/error", fiber.Map{
+		"Title": title,
+		"Error": err.Error(),
+	}, "views/layout")
+}
+
 func anyParser(c *fiber.Ctx, r any) error {
 	switch {
 	case c.Context().IsPost():
@@ -231,6 +463,36 @@ func jwksUri(c *fiber.Ctx) string {
 	return c.BaseURL() + "/jwks/" + c.Params("*")
 }
 
+func hostname(providerUri string) string {
+	host, _, _ := strings.Cut(providerUri, "/")
+	return host
+}
+
 func bearer(c *fiber.Ctx) string {
 	return strings.TrimPrefix(c.Get("Authorization"), "Bearer ")
 }
+
+// checkBrowser allows the launch page and the origins listed by the provider.
+func checkBrowser(c *fiber.Ctx, api *run.Api) error {
+	if origin := c.Get("Origin"); api.CorsOrigin(c.Params("*"), origin) {
+		c.Set("Access-Control-Allow-Origin", origin)
+		c.Set("Vary", "Origin")
+		return nil
+	}
+	if string(c.Context().Referer()) != c.BaseURL()+"/launch/"+c.Params("*") {
+		return fiber.ErrUnauthorized
+	}
+	if c.Get("Sec-Fetch-Site") != "same-origin" {
+		return fiber.ErrUnauthorized
+	}
+	return nil
+}
+
+func authProvider(c *fiber.Ctx, api *run.Api) error {
+	err := api.VerifyProvider(c.BaseURL(), c.Params("*"), bearer(c))
+	if err != nil {
+		log.Error().Err(err).Str("provider", c.Params("*")).Msg("authProvider")
+		return fiber.ErrUnauthorized
+	}
+	return nil
+}
@@ -3,18 +3,36 @@ package run
 import (
 	"encoding/json"
 	"reflect"
+	"sync"
 	"time"
 	"unsafe"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"github.com/rayuruno/ltirun/internal/flight"
 	"github.com/rayuruno/ltirun/lti"
 )
 
 type Consumer struct {
-	Id       string
-	Tool     *lti.Registration
-	Platform *lti.Platform
+	Id         string
+	Tool       *lti.Registration
+	Platform   *lti.Platform
+	ConfigHash string
+	Disabled   bool
+	// Pending until the provider proved it controls its domain
+	Pending bool
+	// Deferred until the provider approves the registration
+	Deferred bool
+	// ExcludedMessages the admin deselected at registration, see messageKey
+	ExcludedMessages []string
+	// DeploymentIds of the platform accepted for this (issuer, client_id)
+	DeploymentIds []string
+	// PendingDeployments launched but waiting for the provider's approval
+	PendingDeployments []string
+	// DeploymentPolicy overrides the provider's policy for new deployment ids
+	DeploymentPolicy string
+	// Profile overrides the profile of the platform's product family
+	Profile string
 }
 
 type Session struct {
@@ -27,6 +45,8 @@ type Store interface {
 	Get(key string) ([]byte, error)
 	Set(key string, val []byte, exp time.Duration) error
 	Delete(key string) error
+	// Keys lists the keys starting with prefix.
+	Keys(prefix string) ([]string, error)
 	Reset() error
 	Close() error
 }
@@ -35,11 +55,16 @@ type KeyStore interface {
 	Jwks(id string) ([]byte, error)
 	Sign(payload jwt.Claims, id string) (string, error)
 	Verify(signed string, jwksUri string) (*jwt.Token, error)
+	// VerifyKey also returns the thumbprint of the public key which verified the token.
+	VerifyKey(signed string, jwksUri string) (*jwt.Token, string, error)
+	Rotate(id string) error
 }
 
 type Api struct {
 	st Store
 	ks KeyStore
+	fl flight.Group
+	mu sync.Mutex
 }
 
 func New(st Store, ks KeyStore) *Api {
@@ -71,6 +96,70 @@ func get[T any](st Store, k string) (*T, error) {
 	return &v, nil
 }
 
+// addIndex appends id to the list stored at k unless it is already there.
+func (api *Api) addIndex(k, id string) error {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	ids, _ := get[[]string](api.st, k)
+	if ids == nil {
+		ids = new([]string)
+	}
+	for _, v := range *ids {
+		if v == id {
+			return nil
+		}
+	}
+	return set(api.st, k, append(*ids, id), 0)
+}
+
+// refreshIndex is addIndex for indexes which expire, every call restarts the ttl.
+func (api *Api) refreshIndex(k, id string, ttl time.Duration) error {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	ids, _ := get[[]string](api.st, k)
+	if ids == nil {
+		ids = new([]string)
+	}
+	for _, v := range *ids {
+		if v == id {
+			return set(api.st, k, *ids, ttl)
+		}
+	}
+	return set(api.st, k, append(*ids, id), ttl)
+}
+
+func (api *Api) removeIndex(k, id string) error {
+	return api.pruneIndex(k, id, 0)
+}
+
+// pruneIndex removes id from an index which expires after ttl.
+func (api *Api) pruneIndex(k, id string, ttl time.Duration) error {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	ids, err := get[[]string](api.st, k)
+	if err != nil {
+		return nil
+	}
+	rest := (*ids)[:0]
+	for _, v := range *ids {
+		if v != id {
+			rest = append(rest, v)
+		}
+	}
+	if len(rest) == 0 {
+		return api.st.Delete(k)
+	}
+	return set(api.st, k, rest, ttl)
+}
+
+func index(st Store, k string) []string {
+	ids, err := get[[]string](st, k)
+	if err != nil {
+		return nil
+	}
+	return *ids
+}
+
 func b2s(b []byte) string {
 	return *(*string)(unsafe.Pointer(&b))
 }
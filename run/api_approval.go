@@ -0,0 +1,88 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/carlmjohnson/requests"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ApprovalApprove = "approve"
+	ApprovalReject  = "reject"
+	ApprovalDefer   = "defer"
+)
+
+// ApprovalRequest is posted to the provider's approval webhook before a registration is stored.
+type ApprovalRequest struct {
+	ConsumerId    string `json:"consumer_id"`
+	Issuer        string `json:"issuer"`
+	ProductFamily string `json:"product_family,omitempty"`
+	ClientId      string `json:"client_id"`
+	DeploymentId  string `json:"deployment_id,omitempty"`
+}
+
+type ApprovalResponse struct {
+	Decision string `json:"decision"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// requestApproval asks the provider's webhook, registrations are deferred when it can't answer.
+func (api *Api) requestApproval(providerUri string, c *Consumer) *ApprovalResponse {
+	webhook := api.GetSettings(providerUri).ApprovalWebhook
+	if webhook == "" {
+		webhook = api.extension(providerUri).Webhooks.Approval
+	}
+	if webhook == "" {
+		return &ApprovalResponse{Decision: ApprovalApprove}
+	}
+	res, err := api.postApproval(webhook, c)
+	if err != nil {
+		log.Error().Err(err).Str("provider", providerUri).Msg("approval webhook")
+		return &ApprovalResponse{Decision: ApprovalDefer, Reason: err.Error()}
+	}
+	switch res.Decision {
+	case ApprovalApprove, ApprovalReject, ApprovalDefer:
+		return res
+	default:
+		return &ApprovalResponse{Decision: ApprovalDefer, Reason: fmt.Sprintf("unknown decision %q", res.Decision)}
+	}
+}
+func (api *Api) postApproval(webhook string, c *Consumer) (*ApprovalResponse, error) {
+	s := c.Summary()
+	ar := &ApprovalRequest{
+		ConsumerId:    c.Id,
+		Issuer:        s.Issuer,
+		ProductFamily: s.ProductFamily,
+		ClientId:      s.ClientId,
+	}
+	if len(s.DeploymentIds) > 0 {
+		ar.DeploymentId = s.DeploymentIds[0]
+	}
+	token, err := api.ks.Sign(jwt.RegisteredClaims{
+		Issuer:    c.Tool.Domain,
+		Subject:   c.Id,
+		Audience:  jwt.ClaimStrings{webhook},
+		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(time.Minute * 5)),
+	}, c.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	res := new(ApprovalResponse)
+	return res, requests.
+		URL(webhook).
+		Method(http.MethodPost).
+		Bearer(token).
+		BodyJSON(ar).
+		ToJSON(res).
+		Fetch(ctx)
+}
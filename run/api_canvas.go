@@ -0,0 +1,108 @@
+package run
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rayuruno/ltirun/internal/check"
+	"github.com/rayuruno/ltirun/lti"
+)
+
+var canvasScopes = []string{
+	scopeLineItem,
+	scopeLineItemReadonly,
+	scopeResultReadonly,
+	scopeScore,
+	scopeMembership,
+}
+
+var canvasPlacements = map[string][]string{
+	"LtiResourceLinkRequest": {"course_navigation"},
+	"LtiDeepLinkingRequest":  {"link_selection"},
+}
+
+// CanvasConfig renders the proxied tool config as a Canvas developer key configuration.
+func (api *Api) CanvasConfig(serviceUrl, providerUri string, cc *lti.CanvasConfig) error {
+	t := new(lti.Tool)
+	if err := api.LoadToolConfig(serviceUrl, providerUri, t); err != nil {
+		return err
+	}
+	cc.Title = t.ClientName
+	cc.Description = t.Description
+	if cc.Description == "" {
+		cc.Description = t.ClientName
+	}
+	cc.OidcInitiationUrl = t.InitiateLoginUri
+	cc.TargetLinkUri = t.TargetLinkUri
+	cc.PublicJwkUrl = t.JwksUri
+	cc.Scopes = []string{}
+	for _, s := range strings.Fields(t.Scope) {
+		if check.ContainsAny(canvasScopes, s) {
+			cc.Scopes = append(cc.Scopes, s)
+		}
+	}
+	cc.CustomFields = canvasCustomFields(t.CustomParameters)
+
+	ext := lti.CanvasExtension{
+		Domain:       t.Domain,
+		ToolId:       providerUri,
+		Platform:     "canvas.instructure.com",
+		PrivacyLevel: "anonymous",
+		Settings: lti.CanvasSettings{
+			Text:       t.ClientName,
+			IconUrl:    t.LogoUri,
+			Placements: []lti.CanvasPlacement{},
+		},
+	}
+	if check.ContainsAny(t.Claims, "name", "email", "given_name", "family_name") {
+		ext.PrivacyLevel = "public"
+	}
+	for _, m := range t.Messages {
+		placements := m.Placements
+		if len(placements) == 0 {
+			placements = canvasPlacements[m.Type]
+		}
+		if _, ok := canvasPlacements[m.Type]; !ok {
+			continue
+		}
+		targetLinkUri := m.TargetLinkUri
+		if targetLinkUri == "" {
+			targetLinkUri = t.TargetLinkUri
+		}
+		for _, p := range placements {
+			// Canvas keeps one placement per name, the first message wins
+			if hasCanvasPlacement(ext.Settings.Placements, p) {
+				continue
+			}
+			ext.Settings.Placements = append(ext.Settings.Placements, lti.CanvasPlacement{
+				Placement:     p,
+				MessageType:   m.Type,
+				TargetLinkUri: targetLinkUri,
+				Text:          m.Label,
+				IconUrl:       m.IconUri,
+			})
+		}
+	}
+	cc.Extensions = []lti.CanvasExtension{ext}
+	return nil
+}
+
+func hasCanvasPlacement(placements []lti.CanvasPlacement, name string) bool {
+	for _, p := range placements {
+		if p.Placement == name {
+			return true
+		}
+	}
+	return false
+}
+
+func canvasCustomFields(params map[string]any) map[string]string {
+	if len(params) == 0 {
+		return nil
+	}
+	fields := make(map[string]string, len(params))
+	for k, v := range params {
+		fields[k] = fmt.Sprint(v)
+	}
+	return fields
+}
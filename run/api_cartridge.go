@@ -0,0 +1,127 @@
+package run
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/rayuruno/ltirun/lti"
+)
+
+// CartridgeLinks returns a basic_lti_link with the lti 1.3 extension properties for every
+// resource link message of the provider.
+func (api *Api) CartridgeLinks(serviceUrl, providerUri string) ([]*lti.BasicLtiLink, error) {
+	t := new(lti.Tool)
+	if err := api.LoadToolConfig(serviceUrl, providerUri, t); err != nil {
+		return nil, err
+	}
+	var links []*lti.BasicLtiLink
+	for _, m := range t.Messages {
+		if m.Type != "LtiResourceLinkRequest" {
+			continue
+		}
+		targetLinkUri := m.TargetLinkUri
+		if targetLinkUri == "" {
+			targetLinkUri = t.TargetLinkUri
+		}
+		l := lti.NewBasicLtiLink()
+		l.Title = m.Label
+		if l.Title == "" {
+			l.Title = t.ClientName
+		}
+		l.Description = t.Description
+		l.LaunchUrl = targetLinkUri
+		l.SecureLaunchUrl = targetLinkUri
+		l.Icon = m.IconUri
+		l.Vendor = lti.LtiVendor{Code: t.Domain, Name: t.ClientName, Url: t.ClientUri}
+		l.Custom = cartridgeProperties(t.CustomParameters, m.CustomParameters)
+		l.Extensions = lti.LtiExtensions{
+			Platform: "https://purl.imsglobal.org/spec/lti/v1p3",
+			Properties: []lti.LtiProperty{
+				{Name: "lti_version", Value: "1.3.0"},
+				{Name: "message_type", Value: m.Type},
+				{Name: "target_link_uri", Value: targetLinkUri},
+				{Name: "oidc_initiation_url", Value: t.InitiateLoginUri},
+				{Name: "public_jwk_url", Value: t.JwksUri},
+				{Name: "domain", Value: t.Domain},
+			},
+		}
+		links = append(links, l)
+	}
+	if len(links) == 0 {
+		return nil, fmt.Errorf("no LtiResourceLinkRequest messages for %s", providerUri)
+	}
+	return links, nil
+}
+
+// WriteCartridge writes a common cartridge package with one lti link per resource link message.
+func (api *Api) WriteCartridge(serviceUrl, providerUri string, w io.Writer) error {
+	links, err := api.CartridgeLinks(serviceUrl, providerUri)
+	if err != nil {
+		return err
+	}
+	m := lti.NewCartridgeManifest("M_" + hashid(providerUri))
+	root := lti.CartridgeItem{Identifier: "root"}
+	z := zip.NewWriter(w)
+	for i, l := range links {
+		id := fmt.Sprintf("LTI%03d", i+1)
+		href := id + ".xml"
+		r := lti.CartridgeResource{Identifier: id, Type: "imsbasiclti_xmlv1p3"}
+		r.File.Href = href
+		m.Resources = append(m.Resources, r)
+		root.Items = append(root.Items, lti.CartridgeItem{Identifier: "I_" + id, IdentifierRef: id, Title: l.Title})
+		if err := writeXML(z, href, l); err != nil {
+			return err
+		}
+	}
+	m.Organizations = []lti.CartridgeOrganization{{Identifier: "O_1", Structure: "rooted-hierarchy", Item: root}}
+	if err := writeXML(z, "imsmanifest.xml", m); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+func writeXML(z *zip.Writer, name string, v any) error {
+	f, err := z.Create(name)
+	if err != nil {
+		return err
+	}
+	b, err := MarshalXML(v)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	return err
+}
+
+func MarshalXML(v any) ([]byte, error) {
+	b, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+func cartridgeProperties(params ...map[string]any) *lti.LtiProperties {
+	merged := make(map[string]string)
+	for _, p := range params {
+		for k, v := range p {
+			merged[k] = fmt.Sprint(v)
+		}
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(merged))
+	for k := range merged {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	props := new(lti.LtiProperties)
+	for _, k := range names {
+		props.Properties = append(props.Properties, lti.LtiProperty{Name: k, Value: merged[k]})
+	}
+	return props
+}
@@ -3,6 +3,7 @@ package run
 import (
 	"context"
 	"fmt"
+	"html/template"
 	"net/http"
 	"net/url"
 	"strings"
@@ -16,10 +17,18 @@ import (
 )
 
 func (api *Api) Authn(providerUri string, i *lti.LoginInit) (string, error) {
-	c, err := get[Consumer](api.st, consumerId(providerUri, i))
+	c, err := api.findConsumer(providerUri, i)
 	if err != nil {
 		return "", err
 	}
+	if err := c.active(); err != nil {
+		return "", err
+	}
+	profile := c.profile()
+	i.DeploymentId = profile.deploymentId(i)
+	if err := api.checkPolicy(providerUri, PolicyLogin, c.auditEntry(i.DeploymentId)); err != nil {
+		return "", err
+	}
 
 	targetLinkUrl, err := url.Parse(i.TargetLinkUri)
 	if err != nil {
@@ -32,7 +41,7 @@ func (api *Api) Authn(providerUri string, i *lti.LoginInit) (string, error) {
 	state := hashid(i.LoginHint)
 	nonce := hashid(state)
 
-	err = set(api.st, state, i, time.Minute*1)
+	err = set(api.st, state, &loginState{Init: i, ConsumerId: c.Id}, time.Minute*1)
 	if err != nil {
 		return "", err
 	}
@@ -40,14 +49,14 @@ func (api *Api) Authn(providerUri string, i *lti.LoginInit) (string, error) {
 	ar := &lti.AuthenticateRequest{
 		Scope:          "openid",
 		ResponseType:   "id_token",
-		ClientId:       i.ClientId,
+		ClientId:       c.Tool.ClientId,
 		RedirectUri:    i.TargetLinkUri,
 		LoginHint:      i.LoginHint,
 		LtiMessageHint: i.LtiMessageHint,
 		State:          state,
 		ResponseMode:   "form_post",
 		Nonce:          nonce,
-		Prompt:         "none",
+		Prompt:         profile.prompt(),
 	}
 	av, err := query.Values(ar)
 	if err != nil {
@@ -56,17 +65,20 @@ func (api *Api) Authn(providerUri string, i *lti.LoginInit) (string, error) {
 	return c.Platform.AuthorizationEndpoint + "?" + av.Encode(), nil
 }
 func (api *Api) Authz(providerUri string, a *lti.AuthenticateResponse) (*Session, error) {
-	i, err := get[lti.LoginInit](api.st, a.State)
+	ls, err := get[loginState](api.st, a.State)
 	if err != nil {
 		return nil, err
 	}
-	if hashid(i.LoginHint) != a.State {
+	if hashid(ls.Init.LoginHint) != a.State {
 		return nil, fmt.Errorf("invalid state")
 	}
-	c, err := get[Consumer](api.st, consumerId(providerUri, i))
+	c, err := get[Consumer](api.st, ls.ConsumerId)
 	if err != nil {
 		return nil, err
 	}
+	if err := c.active(); err != nil {
+		return nil, err
+	}
 	token, err := api.ks.Verify(a.IdToken, c.Platform.JwksUri)
 	if err != nil {
 		return nil, err
@@ -75,6 +87,16 @@ func (api *Api) Authz(providerUri string, a *lti.AuthenticateResponse) (*Session
 	if s.Claims["nonce"] != hashid(a.State) {
 		return nil, fmt.Errorf("invalid nonce")
 	}
+	if err := c.profile().checkIdToken(c, s.Claims); err != nil {
+		return nil, err
+	}
+	deploymentId, _ := s.Claims[deploymentIdClaim].(string)
+	if err := api.checkPolicy(providerUri, PolicyLaunch, c.auditEntry(deploymentId)); err != nil {
+		return nil, err
+	}
+	if err := api.acceptDeployment(providerUri, c, deploymentId); err != nil {
+		return nil, err
+	}
 	exp, err := token.Claims.GetExpirationTime()
 	if err != nil {
 		return nil, err
@@ -83,19 +105,29 @@ func (api *Api) Authz(providerUri string, a *lti.AuthenticateResponse) (*Session
 	if err != nil {
 		return nil, err
 	}
+	err = api.storeLaunchContext(providerUri, s)
+	if err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 func (api *Api) Launch(s *Session, b *string) error {
-	uri, err := getProviderTargetLinkUri(s)
+	providerUri, _, _ := strings.Cut(s.Consumer.Id, " ")
+	ext := api.extension(providerUri)
+	uri, err := getProviderTargetLinkUri(s, ext)
 	if err != nil {
 		return err
 	}
+	claims := ext.filterClaims(s.Claims)
+	if ext.LaunchMode == LaunchFormPost {
+		return api.formPostLaunch(s, uri, claims, b)
+	}
 	token, err := api.ks.Sign(jwt.RegisteredClaims{
 		Issuer:    s.Consumer.Tool.Domain,
 		Subject:   s.Id,
 		Audience:  jwt.ClaimStrings{uri},
 		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(time.Hour * 2)),
+		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(launchTokenLife)),
 		ID:        hashid(s.Id),
 	}, s.Consumer.Id)
 	if err != nil {
@@ -109,20 +141,58 @@ func (api *Api) Launch(s *Session, b *string) error {
 		URL(uri).
 		Method(http.MethodPost).
 		Bearer(token).
-		BodyJSON(s.Claims).
+		BodyJSON(claims).
 		ContentType("text/html").
 		ToString(b).
 		Fetch(ctx)
 }
 
-func consumerId(providerUri string, i *lti.LoginInit) string {
-	return providerUri + " " + i.Iss + " " + i.ClientId + " " + i.DeploymentId
+// formPostLaunch renders a page which posts a token signed by ltirun to the provider, the
+// platform's claims are nested unchanged under launchClaim.
+func (api *Api) formPostLaunch(s *Session, uri string, claims jwt.MapClaims, b *string) error {
+	now := time.Now().UTC()
+	token, err := api.ks.Sign(jwt.MapClaims{
+		"iss":        s.Consumer.Tool.Domain,
+		"aud":        uri,
+		"iat":        now.Unix(),
+		"exp":        now.Add(launchTokenLife).Unix(),
+		"jti":        hashid(s.Id),
+		sessionClaim: s.Id,
+		launchClaim:  claims,
+	}, s.Consumer.Id)
+	if err != nil {
+		return err
+	}
+	var buf strings.Builder
+	err = formPostTemplate.Execute(&buf, map[string]string{"Action": uri, "IdToken": token})
+	*b = buf.String()
+	return err
+}
+
+const (
+	// sessionClaim carries the session id of form_post launches
+	sessionClaim = "https://lti.run/claim/session"
+	launchClaim  = "https://lti.run/claim/launch"
+)
+
+var formPostTemplate = template.Must(template.New("form_post").Parse(`<!DOCTYPE html>
+<html>
+<body onload="document.forms[0].submit()">
+<form method="POST" action="{{.Action}}">
+<input type="hidden" name="id_token" value="{{.IdToken}}" />
+<noscript><button type="submit">Continue</button></noscript>
+</form>
+</body>
+</html>`))
+
+func consumerId(providerUri, iss, clientId string) string {
+	return providerUri + " " + iss + " " + clientId
 }
-func getProviderTargetLinkUri(s *Session) (string, error) {
+func getProviderTargetLinkUri(s *Session, ext *Extension) (string, error) {
 	providerUri, _, _ := strings.Cut(s.Consumer.Id, " ")
-	provUrl, err := url.Parse("https://" + providerUri)
+	provUrl, err := providerUrl(providerUri)
 	if err != nil {
 		return "", err
 	}
-	return provUrl.JoinPath("lti/launch").String(), nil
+	return provUrl.JoinPath(ext.launchPath()).String(), nil
 }
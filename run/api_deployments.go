@@ -0,0 +1,156 @@
+package run
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rayuruno/ltirun/internal/check"
+)
+
+const (
+	// DeploymentAuto accepts new deployment ids on their first valid launch.
+	DeploymentAuto = "auto"
+	// DeploymentApprove keeps new deployment ids pending until the provider approves them.
+	DeploymentApprove = "approve"
+)
+
+// loadConsumer reads the registration of (issuer, client_id), registrations stored per
+// deployment by earlier versions are merged into it on first use.
+func (api *Api) loadConsumer(providerUri, iss, clientId, deploymentId string) (*Consumer, error) {
+	id := consumerId(providerUri, iss, clientId)
+	c, err := get[Consumer](api.st, id)
+	if err == nil && (deploymentId == "" || check.ContainsAny(c.DeploymentIds, deploymentId)) {
+		return c, nil
+	}
+	legacyIds := api.legacyConsumerIds(providerUri, id, deploymentId)
+	if len(legacyIds) == 0 {
+		if err != nil {
+			return nil, fmt.Errorf("unknown registration %s", id)
+		}
+		return c, nil
+	}
+	v, err := api.fl.Do("migrate "+id, func() (any, error) {
+		return api.migrateConsumer(providerUri, id, legacyIds)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Consumer), nil
+}
+
+// legacyConsumerIds lists the per deployment keys of a registration, keys stored before
+// the consumers index existed are only found for the launching deployment.
+func (api *Api) legacyConsumerIds(providerUri, id, deploymentId string) []string {
+	var ids []string
+	for _, k := range index(api.st, consumersIndex(providerUri)) {
+		if strings.HasPrefix(k, id+" ") {
+			ids = append(ids, k)
+		}
+	}
+	if k := id + " " + deploymentId; deploymentId != "" && !check.ContainsAny(ids, k) {
+		if _, err := get[Consumer](api.st, k); err == nil {
+			ids = append(ids, k)
+		}
+	}
+	return ids
+}
+
+// migrateConsumer merges the deployments of every legacy key into the registration.
+func (api *Api) migrateConsumer(providerUri, id string, legacyIds []string) (*Consumer, error) {
+	c, _ := get[Consumer](api.st, id)
+	var migrated []string
+	for _, k := range legacyIds {
+		l, err := get[Consumer](api.st, k)
+		if err != nil {
+			continue
+		}
+		if c == nil {
+			c = l
+			c.Id = id
+		}
+		if d := strings.TrimPrefix(k, id+" "); d != "" && !check.ContainsAny(c.DeploymentIds, d) {
+			c.DeploymentIds = append(c.DeploymentIds, d)
+		}
+		migrated = append(migrated, k)
+	}
+	if c == nil {
+		return nil, fmt.Errorf("unknown registration %s", id)
+	}
+	if err := set(api.st, c.Id, c, 0); err != nil {
+		return nil, err
+	}
+	if err := api.indexConsumer(providerUri, c); err != nil {
+		return nil, err
+	}
+	for _, k := range migrated {
+		if err := api.removeIndex(consumersIndex(providerUri), k); err != nil {
+			return nil, err
+		}
+		if err := api.st.Delete(k); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (api *Api) deploymentPolicy(providerUri string, c *Consumer) string {
+	if c.DeploymentPolicy != "" {
+		return c.DeploymentPolicy
+	}
+	if p := api.GetSettings(providerUri).DeploymentPolicy; p != "" {
+		return p
+	}
+	return DeploymentApprove
+}
+
+// acceptDeployment runs after the id_token was verified, an unknown deployment id is added
+// under the auto policy and otherwise recorded as pending until the provider approves it.
+func (api *Api) acceptDeployment(providerUri string, c *Consumer, deploymentId string) error {
+	if check.ContainsAny(c.DeploymentIds, deploymentId) {
+		return nil
+	}
+	if deploymentId == "" {
+		return fmt.Errorf("unknown deployment %q", deploymentId)
+	}
+	auto := api.deploymentPolicy(providerUri, c) == DeploymentAuto
+	if !auto && check.ContainsAny(c.PendingDeployments, deploymentId) {
+		return fmt.Errorf("deployment %s awaiting provider approval", deploymentId)
+	}
+	updated, err := api.updateConsumer(c.Id, func(c *Consumer) error {
+		switch {
+		case check.ContainsAny(c.DeploymentIds, deploymentId):
+		case auto:
+			c.DeploymentIds = append(c.DeploymentIds, deploymentId)
+			c.PendingDeployments = without(c.PendingDeployments, deploymentId)
+		case !check.ContainsAny(c.PendingDeployments, deploymentId):
+			c.PendingDeployments = append(c.PendingDeployments, deploymentId)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	*c = *updated
+	if !check.ContainsAny(c.DeploymentIds, deploymentId) {
+		return fmt.Errorf("deployment %s awaiting provider approval", deploymentId)
+	}
+	return nil
+}
+
+func checkDeploymentPolicy(p string) error {
+	switch p {
+	case "", DeploymentAuto, DeploymentApprove:
+		return nil
+	}
+	return fmt.Errorf("unknown deployment policy %q", p)
+}
+
+func without(a []string, v string) []string {
+	var rest []string
+	for _, x := range a {
+		if x != v {
+			rest = append(rest, x)
+		}
+	}
+	return rest
+}
@@ -0,0 +1,137 @@
+package run
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/rayuruno/ltirun/internal/check"
+	"github.com/rayuruno/ltirun/lti"
+)
+
+func TestLoadConsumerMigratesLegacyDeployments(t *testing.T) {
+	const (
+		provider = "tool.example.com"
+		iss      = "https://lms.example.com"
+	)
+	id := consumerId(provider, iss, "client")
+	tests := []struct {
+		name         string
+		indexed      []string
+		unindexed    []string
+		stored       []string
+		deploymentId string
+		want         []string
+		wantErr      bool
+	}{
+		{"every indexed deployment", []string{"1", "2", "3"}, nil, nil, "2", []string{"1", "2", "3"}, false},
+		{"launch without deployment id", []string{"1", "2"}, nil, nil, "", []string{"1", "2"}, false},
+		{"stored before the index", []string{"1"}, []string{"2"}, nil, "2", []string{"1", "2"}, false},
+		{"into a migrated registration", []string{"2"}, nil, []string{"1"}, "2", []string{"1", "2"}, false},
+		{"unknown deployment of a migrated registration", nil, nil, []string{"1"}, "2", []string{"1"}, false},
+		{"unknown registration", nil, nil, nil, "1", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := New(newMemStore(), nil)
+			legacy := func(d string) string {
+				k := id + " " + d
+				set(api.st, k, &Consumer{Id: k, Platform: &lti.Platform{Issuer: iss}}, 0)
+				return k
+			}
+			for _, d := range tt.indexed {
+				api.addIndex(consumersIndex(provider), legacy(d))
+			}
+			for _, d := range tt.unindexed {
+				legacy(d)
+			}
+			if tt.stored != nil {
+				c := &Consumer{Id: id, Platform: &lti.Platform{Issuer: iss}, DeploymentIds: tt.stored}
+				set(api.st, id, c, 0)
+				api.indexConsumer(provider, c)
+			}
+			// another client of the same platform is left alone
+			other := consumerId(provider, iss, "client2") + " 1"
+			set(api.st, other, &Consumer{Id: other, Platform: &lti.Platform{Issuer: iss}}, 0)
+			api.addIndex(consumersIndex(provider), other)
+
+			c, err := api.loadConsumer(provider, iss, "client", tt.deploymentId)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConsumer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got := append([]string{}, c.DeploymentIds...)
+			sort.Strings(got)
+			if c.Id != id || !equalStrings(got, tt.want) {
+				t.Errorf("loadConsumer() = %s %v, want %s %v", c.Id, got, id, tt.want)
+			}
+			for _, d := range append(tt.indexed, tt.unindexed...) {
+				if b, _ := api.st.Get(id + " " + d); b != nil {
+					t.Errorf("legacy deployment %s not deleted", d)
+				}
+			}
+			ids := index(api.st, consumersIndex(provider))
+			if !check.ContainsAny(ids, id) || !check.ContainsAny(ids, other) || len(ids) != 2 {
+				t.Errorf("consumers index %v", ids)
+			}
+			if b, _ := api.st.Get(other); b == nil {
+				t.Error("other client deleted")
+			}
+		})
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAcceptDeployment(t *testing.T) {
+	const provider = "tool.example.com"
+	tests := []struct {
+		name         string
+		policy       string
+		known        []string
+		pending      []string
+		deploymentId string
+		wantErr      bool
+		wantKnown    []string
+		wantPending  []string
+	}{
+		{"known", "", []string{"1"}, nil, "1", false, []string{"1"}, nil},
+		{"approve records pending", "", []string{"1"}, nil, "2", true, []string{"1"}, []string{"2"}},
+		{"approve pending once", DeploymentApprove, []string{"1"}, []string{"2"}, "2", true, []string{"1"}, []string{"2"}},
+		{"auto adds", DeploymentAuto, []string{"1"}, []string{"2"}, "2", false, []string{"1", "2"}, nil},
+		{"missing deployment id", DeploymentAuto, []string{"1"}, nil, "", true, []string{"1"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := New(newMemStore(), nil)
+			c := &Consumer{
+				Id:                 consumerId(provider, "https://lms.example.com", "client"),
+				DeploymentIds:      tt.known,
+				PendingDeployments: tt.pending,
+				DeploymentPolicy:   tt.policy,
+			}
+			set(api.st, c.Id, c, 0)
+			if err := api.acceptDeployment(provider, c, tt.deploymentId); (err != nil) != tt.wantErr {
+				t.Fatalf("acceptDeployment() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			stored, err := get[Consumer](api.st, c.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !equalStrings(stored.DeploymentIds, tt.wantKnown) || !equalStrings(stored.PendingDeployments, tt.wantPending) {
+				t.Errorf("stored %v pending %v, want %v pending %v", stored.DeploymentIds, stored.PendingDeployments, tt.wantKnown, tt.wantPending)
+			}
+		})
+	}
+}
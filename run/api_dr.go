@@ -1,36 +1,194 @@
 package run
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/carlmjohnson/requests"
+	"github.com/google/uuid"
+	"github.com/rayuruno/ltirun/internal/check"
 	"github.com/rayuruno/ltirun/lti"
+	"github.com/rs/zerolog/log"
 )
 
 func (api *Api) GetPlatformConfig(endpoint, token string, p *lti.Platform) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*1)
 	defer cancel()
-	return requests.
+	rb := requests.
 		URL(endpoint).
 		Method(http.MethodGet).
-		Bearer(token).
-		ToJSON(p).
-		Fetch(ctx)
+		ToJSON(p)
+	if token != "" {
+		rb.Bearer(token)
+	}
+	return rb.Fetch(ctx)
+}
+
+// PrefillPlatform loads the platform's openid configuration for manual registration,
+// by default it is discovered under the issuer.
+func (api *Api) PrefillPlatform(configUrl, issuer string, p *lti.Platform) error {
+	if configUrl == "" {
+		if issuer == "" {
+			return fmt.Errorf("platform configuration url or issuer required")
+		}
+		configUrl = strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	}
+	if err := api.GetPlatformConfig(configUrl, "", p); err != nil {
+		return err
+	}
+	if issuer != "" && p.Issuer != issuer {
+		return fmt.Errorf("issuer mismatch %s %s", issuer, p.Issuer)
+	}
+	return p.Validate("")
+}
+
+type RegistrationDiff struct {
+	Field   string
+	Stored  string
+	Current string
+}
+
+// DiffRegistration compares the platform with the stored registration of the same consumer.
+func (api *Api) DiffRegistration(providerUri string, p *lti.Platform, clientId, deploymentId string) []RegistrationDiff {
+	c, err := api.loadConsumer(providerUri, p.Issuer, clientId, deploymentId)
+	if err != nil {
+		return nil
+	}
+	var diff []RegistrationDiff
+	for _, f := range []RegistrationDiff{
+		{"issuer", c.Platform.Issuer, p.Issuer},
+		{"jwks_uri", c.Platform.JwksUri, p.JwksUri},
+		{"token_endpoint", c.Platform.TokenEndpoint, p.TokenEndpoint},
+		{"authorization_endpoint", c.Platform.AuthorizationEndpoint, p.AuthorizationEndpoint},
+	} {
+		if f.Stored != f.Current {
+			diff = append(diff, f)
+		}
+	}
+	if deploymentId != "" && !check.ContainsAny(c.DeploymentIds, deploymentId) {
+		diff = append(diff, RegistrationDiff{"deployment_id", strings.Join(c.DeploymentIds, " "), deploymentId})
+	}
+	return diff
 }
 func (api *Api) LoadToolConfig(serviceUrl, providerUri string, t *lti.Tool) error {
+	rep := api.diagnoseToolConfig(serviceUrl, providerUri, t)
+	if rep.ProxyError != "" {
+		return errors.New(rep.ProxyError)
+	}
+	if rep.Strict && rep.Err() != nil {
+		return rep.Err()
+	}
+	if rep.Err() == nil && rep.Stale == "" {
+		api.detectToolConfigChange(serviceUrl, providerUri, t)
+	}
+	return nil
+}
+func (api *Api) fetchToolConfig(providerUri string, t *lti.Tool) error {
+	doc, err := api.fetchToolConfigDoc(providerUri)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(doc.Body, t)
+}
+
+// toolConfigDoc is the provider's openid_configuration as cached in the store.
+type toolConfigDoc struct {
+	Body    []byte
+	Status  int
+	ETag    string
+	Expires time.Time
+	// Stale is the error that prevented revalidating the document
+	Stale string
+	// Error is the fetch error of a provider without a good copy, retried after Expires
+	Error string
+}
+
+// fetchToolConfigDoc honors Cache-Control and ETag of the provider's openid_configuration,
+// the last good copy is served when the provider is unreachable. Failed fetches are retried
+// after toolConfigBackoff, concurrent callers share one fetch.
+func (api *Api) fetchToolConfigDoc(providerUri string) (*toolConfigDoc, error) {
+	k := toolConfigKey(providerUri)
+	cached, _ := get[toolConfigDoc](api.st, k)
+	if cached != nil && time.Now().Before(cached.Expires) {
+		return cached.result()
+	}
+	v, err := api.fl.Do(k, func() (any, error) {
+		return api.refreshToolConfigDoc(providerUri, cached)
+	})
+	return v.(*toolConfigDoc), err
+}
+func (api *Api) refreshToolConfigDoc(providerUri string, cached *toolConfigDoc) (*toolConfigDoc, error) {
+	k := toolConfigKey(providerUri)
+	if cached != nil && cached.Error != "" {
+		cached = nil
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*1)
 	defer cancel()
-	requests.
-		URL("https://" + providerUri + "/.well-known/openid_configuration").
+
+	var buf bytes.Buffer
+	h := make(http.Header)
+	status := 0
+	rb := requests.
+		URL(toolConfigUrl(providerUri)).
 		Method(http.MethodGet).
-		ToJSON(t).
-		Fetch(ctx)
-	return proxyToolConfig(serviceUrl, providerUri, t)
+		AddValidator(func(res *http.Response) error {
+			status = res.StatusCode
+			return nil
+		}).
+		CheckStatus(http.StatusOK, http.StatusNotModified).
+		CopyHeaders(h).
+		ToBytesBuffer(&buf)
+	if cached != nil && cached.ETag != "" {
+		rb.Header("If-None-Match", cached.ETag)
+	}
+	err := rb.Fetch(ctx)
+	if err != nil {
+		doc := cached
+		if doc == nil {
+			doc = &toolConfigDoc{Status: status, Error: err.Error()}
+		}
+		doc.Stale = err.Error()
+		doc.Expires = time.Now().Add(toolConfigBackoff)
+		if err := set(api.st, k, doc, toolConfigRetention); err != nil {
+			log.Error().Err(err).Str("provider", providerUri).Msg("toolconfig")
+		}
+		return doc.result()
+	}
+	maxAge, store := cacheControl(h.Get("Cache-Control"))
+	if status == http.StatusNotModified {
+		if cached == nil {
+			return &toolConfigDoc{Status: status}, fmt.Errorf("unexpected %d without cached copy", status)
+		}
+		cached.Stale = ""
+		cached.Expires = time.Now().Add(maxAge)
+		return cached, set(api.st, k, cached, toolConfigRetention)
+	}
+	doc := &toolConfigDoc{
+		Body:    buf.Bytes(),
+		Status:  status,
+		ETag:    h.Get("ETag"),
+		Expires: time.Now().Add(maxAge),
+	}
+	if !store {
+		return doc, api.st.Delete(k)
+	}
+	return doc, set(api.st, k, doc, toolConfigRetention)
+}
+
+func (doc *toolConfigDoc) result() (*toolConfigDoc, error) {
+	if doc.Error != "" {
+		return doc, errors.New(doc.Error)
+	}
+	return doc, nil
 }
 func (api *Api) PostToolConfig(registrationEndpoint, token string, t *lti.Tool, r *lti.Registration) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*1)
@@ -43,16 +201,226 @@ func (api *Api) PostToolConfig(registrationEndpoint, token string, t *lti.Tool,
 		ToJSON(r).
 		Fetch(ctx)
 }
-func (api *Api) StoreRegistration(providerUri string, p *lti.Platform, r *lti.Registration) error {
+
+// PendingConnect is a dynamic registration waiting for the admin's confirmation.
+type PendingConnect struct {
+	Id          string
+	ProviderUri string
+	Init        *lti.RegistrationInit
+	Platform    *lti.Platform
+	Tool        *lti.Tool
+}
+
+type ConnectConfirm struct {
+	Id       string   `form:"id"`
+	Scopes   []string `form:"scope"`
+	Messages []int    `form:"message"`
+}
+
+// BeginConnect validates both configurations and keeps them until the admin confirms.
+func (api *Api) BeginConnect(serviceUrl, providerUri string, i *lti.RegistrationInit) (*PendingConnect, error) {
+	p := new(lti.Platform)
+	t := new(lti.Tool)
+	if err := api.GetPlatformConfig(i.Endpoint, i.Token, p); err != nil {
+		return nil, err
+	}
+	if err := p.Validate(i.Endpoint); err != nil {
+		return nil, err
+	}
+	if err := api.checkPolicy(providerUri, PolicyConnect, &AuditEntry{Issuer: p.Issuer, ProductFamily: p.ProductFamilyCode}); err != nil {
+		return nil, err
+	}
+	if err := api.LoadToolConfig(serviceUrl, providerUri, t); err != nil {
+		return nil, err
+	}
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	if err := p.ValidateMessages(t.Messages); err != nil {
+		return nil, err
+	}
+	t.Scope = intersectScope(t.Scope, p.ScopesSupported)
+	pc := &PendingConnect{
+		Id:          uuid.NewString(),
+		ProviderUri: providerUri,
+		Init:        i,
+		Platform:    p,
+		Tool:        t,
+	}
+	return pc, set(api.st, connectKey(pc.Id), pc, time.Minute*30)
+}
+
+// FinishConnect registers the tool with the scopes and messages the admin kept.
+func (api *Api) FinishConnect(providerUri string, cc *ConnectConfirm) error {
+	pc, err := get[PendingConnect](api.st, connectKey(cc.Id))
+	if err != nil {
+		return fmt.Errorf("registration expired, restart it from the platform")
+	}
+	if pc.ProviderUri != providerUri {
+		return fmt.Errorf("provider mismatch %s %s", pc.ProviderUri, providerUri)
+	}
+	t := pc.Tool
+	scopes := []string{"openid"}
+	for _, s := range strings.Fields(t.Scope) {
+		if s != "openid" && check.ContainsAny(cc.Scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	t.Scope = strings.Join(scopes, " ")
+	var messages []lti.LtiMessage
+	var excluded []string
+	for i, m := range t.Messages {
+		if check.ContainsAny(cc.Messages, i) {
+			messages = append(messages, m)
+		} else {
+			excluded = append(excluded, messageKey(m))
+		}
+	}
+	if len(messages) == 0 {
+		return fmt.Errorf("select at least one message")
+	}
+	t.Messages = messages
+	// the signed statement would restore the provider's values and the deselected messages
+	stripStatement(t)
+	r := new(lti.Registration)
+	if err := api.PostToolConfig(pc.Platform.RegistrationEndpoint, pc.Init.Token, t, r); err != nil {
+		return err
+	}
+	if err := api.StoreRegistration(providerUri, pc.Platform, r, t, excluded); err != nil {
+		return err
+	}
+	return api.st.Delete(connectKey(cc.Id))
+}
+
+// StoreRegistration stores the platform's registration, a registration of an already known
+// (issuer, client_id) adds its deployment id to it. t is the tool config that was registered
+// without the excluded messages the admin deselected.
+func (api *Api) StoreRegistration(providerUri string, p *lti.Platform, r *lti.Registration, t *lti.Tool, excluded []string) error {
+	deploymentId := ""
+	if r.Tool != nil {
+		deploymentId = r.DeploymentId
+	}
+	if err := api.checkPolicy(providerUri, PolicyRegister, &AuditEntry{
+		Issuer:        p.Issuer,
+		ProductFamily: p.ProductFamilyCode,
+		DeploymentId:  deploymentId,
+		ClientId:      r.ClientId,
+	}); err != nil {
+		return err
+	}
+	if c, err := api.loadConsumer(providerUri, p.Issuer, r.ClientId, deploymentId); err == nil {
+		return api.reregisterConsumer(providerUri, c, p, r, t, excluded, deploymentId)
+	}
 	c := &Consumer{
-		Id:       providerUri + " " + p.Issuer + " " + r.ClientId + " " + r.DeploymentId,
-		Tool:     r,
-		Platform: p,
+		Id:               consumerId(providerUri, p.Issuer, r.ClientId),
+		Tool:             r,
+		Platform:         p,
+		ExcludedMessages: excluded,
+	}
+	c.ConfigHash = toolConfigHash(c.registeredConfig(t))
+	if deploymentId != "" {
+		c.DeploymentIds = []string{deploymentId}
+	}
+	if !api.DomainVerified(providerUri) && api.VerifyDomain(providerUri) != nil {
+		c.Pending = true
+	}
+	switch a := api.requestApproval(providerUri, c); a.Decision {
+	case ApprovalReject:
+		return fmt.Errorf("registration rejected by provider %s", a.Reason)
+	case ApprovalDefer:
+		c.Deferred = true
+	}
+	if err := set(api.st, c.Id, c, 0); err != nil {
+		return err
 	}
-	return set(api.st, c.Id, c, 0)
+	return api.indexConsumer(providerUri, c)
 }
 
-func proxyToolConfig(serviceUrl, providerUri string, t *lti.Tool) error {
+// reregisterConsumer applies a registration of a known (issuer, client_id). The registration
+// request is not authenticated, so changed platform endpoints go through the provider's
+// approval, the domain is checked again and new deployment ids follow the deployment policy.
+func (api *Api) reregisterConsumer(providerUri string, c *Consumer, p *lti.Platform, r *lti.Registration, t *lti.Tool, excluded []string, deploymentId string) error {
+	decision := ApprovalApprove
+	if platformChanged(c.Platform, p) {
+		candidate := *c
+		candidate.Platform = p
+		candidate.Tool = r
+		a := api.requestApproval(providerUri, &candidate)
+		if a.Decision == ApprovalReject {
+			return fmt.Errorf("registration rejected by provider %s", a.Reason)
+		}
+		decision = a.Decision
+	}
+	pending := !api.DomainVerified(providerUri) && api.VerifyDomain(providerUri) != nil
+	auto := api.deploymentPolicy(providerUri, c) == DeploymentAuto
+	_, err := api.updateConsumer(c.Id, func(c *Consumer) error {
+		c.Tool = r
+		c.Platform = p
+		c.ExcludedMessages = excluded
+		c.ConfigHash = toolConfigHash(c.registeredConfig(t))
+		c.Pending = pending
+		if decision == ApprovalDefer {
+			c.Deferred = true
+		}
+		switch {
+		case deploymentId == "" || check.ContainsAny(c.DeploymentIds, deploymentId):
+		case auto:
+			c.DeploymentIds = append(c.DeploymentIds, deploymentId)
+			c.PendingDeployments = without(c.PendingDeployments, deploymentId)
+		case !check.ContainsAny(c.PendingDeployments, deploymentId):
+			c.PendingDeployments = append(c.PendingDeployments, deploymentId)
+		}
+		return nil
+	})
+	return err
+}
+
+// platformChanged reports changes of the endpoints ltirun trusts for a consumer.
+func platformChanged(old, p *lti.Platform) bool {
+	return old == nil ||
+		old.JwksUri != p.JwksUri ||
+		old.AuthorizationEndpoint != p.AuthorizationEndpoint ||
+		old.TokenEndpoint != p.TokenEndpoint ||
+		old.RegistrationEndpoint != p.RegistrationEndpoint
+}
+
+const (
+	toolConfigMaxAge    = time.Minute * 1
+	toolConfigBackoff   = time.Second * 30
+	toolConfigRetention = time.Hour * 24 * 30
+)
+
+func toolConfigKey(providerUri string) string {
+	return "toolconfig " + providerUri
+}
+
+// cacheControl returns the freshness lifetime and whether the response may be stored.
+func cacheControl(header string) (time.Duration, bool) {
+	if header == "" {
+		return toolConfigMaxAge, true
+	}
+	maxAge := time.Duration(0)
+	for _, d := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+		switch strings.ToLower(name) {
+		case "no-store":
+			return 0, false
+		case "no-cache":
+			return 0, true
+		case "max-age":
+			if n, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && n > 0 {
+				maxAge = time.Duration(n) * time.Second
+			}
+		}
+	}
+	return maxAge, true
+}
+
+func toolConfigUrl(providerUri string) string {
+	return providerScheme(providerUri) + "://" + providerUri + "/.well-known/openid_configuration"
+}
+
+func proxyToolConfig(serviceUrl, providerUri string, t *lti.Tool, ext *Extension) error {
 	if t == nil {
 		t = new(lti.Tool)
 	}
@@ -60,13 +428,10 @@ func proxyToolConfig(serviceUrl, providerUri string, t *lti.Tool) error {
 	if err != nil {
 		return err
 	}
-	provUrl, err := url.Parse("https://" + providerUri)
+	provUrl, err := providerUrl(providerUri)
 	if err != nil {
 		return err
 	}
-	if !strings.Contains(provUrl.Hostname(), ".") {
-		return fmt.Errorf("invalid provider uri %s, host missing", providerUri)
-	}
 	jwksUri := srvUrl.JoinPath("jwks").String() + "/" + providerUri
 	initiateLoginUri := srvUrl.JoinPath("login").String() + "/" + providerUri
 	targetLinkUri := srvUrl.JoinPath("launch").String() + "/" + providerUri
@@ -112,13 +477,29 @@ func proxyToolConfig(serviceUrl, providerUri string, t *lti.Tool) error {
 			t.Messages[i].TargetLinkUri = targetLinkUri
 		}
 	}
-	t.Scope = defaultScope
+	requested := ext.Scopes
+	if len(requested) == 0 {
+		requested = strings.Fields(t.Scope)
+	}
+	t.Scope = selectScope(requested)
 	if len(t.Claims) == 0 {
 		t.Claims = defaultClaims
 	}
 	return nil
 }
 
+// providerUrl is the only place where the provider's scheme and host are checked.
+func providerUrl(providerUri string) (*url.URL, error) {
+	provUrl, err := url.Parse(providerScheme(providerUri) + "://" + providerUri)
+	if err != nil {
+		return nil, err
+	}
+	if !isDevProvider(providerUri) && !strings.Contains(provUrl.Hostname(), ".") {
+		return nil, fmt.Errorf("invalid provider uri %s, host missing", providerUri)
+	}
+	return provUrl, nil
+}
+
 var defaultScope = strings.Join([]string{
 	"openid",
 	"https://purl.imsglobal.org/spec/lti-reg/scope/registration.readonly",
@@ -167,3 +548,7 @@ func defaultMessages() []lti.LtiMessage {
 		},
 	}
 }
+
+func connectKey(id string) string {
+	return "connect " + id
+}
@@ -0,0 +1,141 @@
+package run
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rayuruno/ltirun/lti"
+)
+
+func TestCacheControl(t *testing.T) {
+	tests := []struct {
+		header    string
+		wantAge   time.Duration
+		wantStore bool
+	}{
+		{"", toolConfigMaxAge, true},
+		{"max-age=60", time.Minute, true},
+		{"public, max-age=3600", time.Hour, true},
+		{`max-age="120"`, time.Minute * 2, true},
+		{"MAX-AGE=60", time.Minute, true},
+		{"max-age=0", 0, true},
+		{"max-age=-1", 0, true},
+		{"max-age=abc", 0, true},
+		{"public", 0, true},
+		{"no-cache", 0, true},
+		{"max-age=60, no-cache", 0, true},
+		{"no-store", 0, false},
+		{"max-age=60, no-store", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			age, store := cacheControl(tt.header)
+			if age != tt.wantAge || store != tt.wantStore {
+				t.Errorf("cacheControl(%q) = %s, %v, want %s, %v", tt.header, age, store, tt.wantAge, tt.wantStore)
+			}
+		})
+	}
+}
+
+func TestReregisterConsumer(t *testing.T) {
+	// nothing listens here, the approval webhook and domain challenge fail at once
+	const provider = "127.0.0.1:1"
+	platform := func(jwksUri string) *lti.Platform {
+		return &lti.Platform{
+			Issuer:                "https://lms.example.com",
+			AuthorizationEndpoint: "https://lms.example.com/auth",
+			TokenEndpoint:         "https://lms.example.com/token",
+			JwksUri:               jwksUri,
+		}
+	}
+	tests := []struct {
+		name         string
+		verified     bool
+		policy       string
+		jwksUri      string
+		deploymentId string
+		wantJwksUri  string
+		wantKnown    []string
+		wantPending  []string
+		wantActive   bool
+	}{
+		{"same platform", true, "", "https://lms.example.com/jwks", "1", "https://lms.example.com/jwks", []string{"1"}, nil, true},
+		{"new deployment pending", true, "", "https://lms.example.com/jwks", "2", "https://lms.example.com/jwks", []string{"1"}, []string{"2"}, true},
+		{"new deployment auto", true, DeploymentAuto, "https://lms.example.com/jwks", "2", "https://lms.example.com/jwks", []string{"1", "2"}, nil, true},
+		{"changed keys deferred", true, "", "https://evil.example.com/jwks", "1", "https://evil.example.com/jwks", []string{"1"}, nil, false},
+		{"domain checked again", false, "", "https://lms.example.com/jwks", "1", "https://lms.example.com/jwks", []string{"1"}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := New(newMemStore(), new(fakeKeyStore))
+			set(api.st, settingsKey(provider), &Settings{ApprovalWebhook: "https://127.0.0.1:1/approve"}, 0)
+			if tt.verified {
+				api.st.Set(verifiedKey(provider), []byte("now"), 0)
+			}
+			r := &lti.Registration{ClientId: "client", Tool: &lti.Tool{LtiTool: lti.LtiTool{Domain: "tool.example.com"}}}
+			c := &Consumer{
+				Id:               consumerId(provider, "https://lms.example.com", "client"),
+				Tool:             r,
+				Platform:         platform("https://lms.example.com/jwks"),
+				DeploymentIds:    []string{"1"},
+				DeploymentPolicy: tt.policy,
+			}
+			set(api.st, c.Id, c, 0)
+			if err := api.reregisterConsumer(provider, c, platform(tt.jwksUri), r, &lti.Tool{}, nil, tt.deploymentId); err != nil {
+				t.Fatal(err)
+			}
+			stored, err := get[Consumer](api.st, c.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Platform.JwksUri != tt.wantJwksUri {
+				t.Errorf("jwks_uri %s, want %s", stored.Platform.JwksUri, tt.wantJwksUri)
+			}
+			if !equalStrings(stored.DeploymentIds, tt.wantKnown) || !equalStrings(stored.PendingDeployments, tt.wantPending) {
+				t.Errorf("deployments %v pending %v, want %v pending %v", stored.DeploymentIds, stored.PendingDeployments, tt.wantKnown, tt.wantPending)
+			}
+			if active := stored.active() == nil; active != tt.wantActive {
+				t.Errorf("active %v, want %v", active, tt.wantActive)
+			}
+		})
+	}
+}
+
+func TestToolConfigBackoff(t *testing.T) {
+	// nothing listens here, every fetch fails at once
+	const provider = "127.0.0.1:1"
+	tests := []struct {
+		name    string
+		cached  *toolConfigDoc
+		wantErr bool
+	}{
+		{"stale copy", &toolConfigDoc{Body: []byte(`{"client_name":"tool"}`), Status: 200, Expires: time.Now().Add(-time.Minute)}, false},
+		{"no copy", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := New(newMemStore(), nil)
+			if tt.cached != nil {
+				set(api.st, toolConfigKey(provider), tt.cached, 0)
+			}
+			doc, err := api.fetchToolConfigDoc(provider)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetchToolConfigDoc() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if doc.Stale == "" {
+				t.Error("fetch error not reported as stale")
+			}
+			stored, _ := get[toolConfigDoc](api.st, toolConfigKey(provider))
+			if stored == nil || !stored.Expires.After(time.Now()) {
+				t.Fatalf("failed fetch not backed off: %+v", stored)
+			}
+			// served from the store until the backoff expires
+			stored.Stale = "cached"
+			set(api.st, toolConfigKey(provider), stored, 0)
+			doc, err = api.fetchToolConfigDoc(provider)
+			if (err != nil) != tt.wantErr || doc.Stale != "cached" {
+				t.Errorf("fetchToolConfigDoc() = %+v, %v, want the backed off copy", doc, err)
+			}
+		})
+	}
+}
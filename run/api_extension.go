@@ -0,0 +1,247 @@
+package run
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rayuruno/ltirun/internal/check"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	extensionClaim = "https://lti.run/config"
+
+	// LaunchProxy posts the claims to the provider and serves its response from ltirun.
+	LaunchProxy = "proxy"
+	// LaunchFormPost sends the browser to the provider with a signed id_token.
+	LaunchFormPost = "form_post"
+
+	defaultLaunchPath = "lti/launch"
+)
+
+// Extension is the ltirun block of the provider's openid_configuration, it is never
+// forwarded to platforms.
+type Extension struct {
+	// LaunchPath relative to the provider uri, defaults to lti/launch
+	LaunchPath string `json:"launch_path,omitempty"`
+	LaunchMode string `json:"launch_mode,omitempty"`
+	// ForwardClaims limits the launch claims sent to the provider, empty forwards all
+	ForwardClaims []string `json:"forward_claims,omitempty"`
+	DropClaims    []string `json:"drop_claims,omitempty"`
+	// AllowedIssuers may register and launch, empty allows any
+	AllowedIssuers []string          `json:"allowed_issuers,omitempty"`
+	Webhooks       ExtensionWebhooks `json:"webhooks,omitempty"`
+	// CorsOrigins may call /service and /jwt from the browser
+	CorsOrigins []string `json:"cors_origins,omitempty"`
+	Scopes      []string `json:"scopes,omitempty"`
+	// Unreadable restricting fields, they deny instead of allowing everything
+	Unreadable []string `json:"unreadable,omitempty"`
+}
+
+type ExtensionWebhooks struct {
+	// Approval is used when the provider settings have no approval webhook
+	Approval string `json:"approval,omitempty"`
+	// Outbox is the default callback of queued scores
+	Outbox string `json:"outbox,omitempty"`
+}
+
+// extensionDoc is the last extension read from the provider, kept without expiry so a
+// declared allowlist still applies when the provider is unreachable or sends no-store.
+type extensionDoc struct {
+	Ext     *Extension
+	Error   string
+	Expires time.Time
+}
+
+// extension reads the provider's openid_configuration, invalid fields are ignored and
+// reported by diagnostics.
+func (api *Api) extension(providerUri string) *Extension {
+	doc, err := api.fetchToolConfigDoc(providerUri)
+	return api.parsedExtension(providerUri, doc, err).Ext
+}
+func (api *Api) parsedExtension(providerUri string, doc *toolConfigDoc, err error) *extensionDoc {
+	k := extensionKey(providerUri)
+	stored, _ := get[extensionDoc](api.st, k)
+	if err != nil {
+		if stored != nil {
+			return stored
+		}
+		return &extensionDoc{Ext: new(Extension)}
+	}
+	if stored != nil && stored.Expires.Equal(doc.Expires) {
+		return stored
+	}
+	ed := &extensionDoc{Expires: doc.Expires}
+	ed.Ext, err = parseExtension(providerUri, doc.Body)
+	if err != nil {
+		ed.Error = err.Error()
+	}
+	if err := set(api.st, k, ed, 0); err != nil {
+		log.Error().Err(err).Str("provider", providerUri).Msg("extension")
+	}
+	return ed
+}
+
+// cachedExtension never waits for the provider, an expired copy is refreshed in the background.
+func (api *Api) cachedExtension(providerUri string) *Extension {
+	stored, _ := get[extensionDoc](api.st, extensionKey(providerUri))
+	if stored == nil || time.Now().After(stored.Expires) {
+		go api.fl.Do(extensionKey(providerUri), func() (any, error) {
+			return api.extension(providerUri), nil
+		})
+	}
+	if stored == nil {
+		return new(Extension)
+	}
+	return stored.Ext
+}
+
+// CorsOrigin reports if the provider allows origin to call the browser endpoints.
+func (api *Api) CorsOrigin(providerUri, origin string) bool {
+	return origin != "" && check.ContainsAny(api.cachedExtension(providerUri).CorsOrigins, origin)
+}
+
+// restrictingFields fail closed when they are declared but can't be read.
+var restrictingFields = []string{"allowed_issuers", "forward_claims", "drop_claims"}
+
+// parseExtension validates every field on its own, the returned extension is never nil. A
+// document which isn't json, e.g. an html page served for unknown paths, has no extension.
+func parseExtension(providerUri string, body []byte) (*Extension, error) {
+	ext := new(Extension)
+	doc := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return ext, err
+	}
+	raw, ok := doc[extensionClaim]
+	if !ok {
+		return ext, nil
+	}
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		ext.Unreadable = restrictingFields
+		return ext, fmt.Errorf("%s: %w", extensionClaim, err)
+	}
+	var errs []error
+	field := func(name string, v any) bool {
+		b, ok := fields[name]
+		if !ok {
+			return false
+		}
+		if err := json.Unmarshal(b, v); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			if check.ContainsAny(restrictingFields, name) {
+				ext.Unreadable = append(ext.Unreadable, name)
+			}
+			return false
+		}
+		return true
+	}
+
+	var launchPath, launchMode string
+	if field("launch_path", &launchPath) {
+		if err := checkLaunchPath(launchPath); err != nil {
+			errs = append(errs, err)
+		} else {
+			ext.LaunchPath = launchPath
+		}
+	}
+	if field("launch_mode", &launchMode) {
+		switch launchMode {
+		case "", LaunchProxy, LaunchFormPost:
+			ext.LaunchMode = launchMode
+		default:
+			errs = append(errs, fmt.Errorf("unknown launch_mode %q", launchMode))
+		}
+	}
+	var forward, drop, issuers, origins, scopes []string
+	if field("forward_claims", &forward) {
+		ext.ForwardClaims = forward
+	}
+	if field("drop_claims", &drop) {
+		ext.DropClaims = drop
+	}
+	if field("allowed_issuers", &issuers) {
+		ext.AllowedIssuers = issuers
+	}
+	var webhooks ExtensionWebhooks
+	if field("webhooks", &webhooks) {
+		if err := checkProviderUrl(providerUri, webhooks.Approval); webhooks.Approval != "" && err != nil {
+			errs = append(errs, fmt.Errorf("webhooks.approval: %w", err))
+		} else {
+			ext.Webhooks.Approval = webhooks.Approval
+		}
+		if err := checkProviderUrl(providerUri, webhooks.Outbox); webhooks.Outbox != "" && err != nil {
+			errs = append(errs, fmt.Errorf("webhooks.outbox: %w", err))
+		} else {
+			ext.Webhooks.Outbox = webhooks.Outbox
+		}
+	}
+	if field("cors_origins", &origins) {
+		for _, o := range origins {
+			if err := checkProviderUrl(providerUri, o); err != nil {
+				errs = append(errs, fmt.Errorf("cors_origins: %w", err))
+				continue
+			}
+			ext.CorsOrigins = append(ext.CorsOrigins, o)
+		}
+	}
+	if field("scopes", &scopes) {
+		for _, s := range scopes {
+			if !check.ContainsAny(allowedScopes, s) {
+				errs = append(errs, fmt.Errorf("scope not allowed %s", s))
+				continue
+			}
+			ext.Scopes = append(ext.Scopes, s)
+		}
+	}
+	return ext, errors.Join(errs...)
+}
+
+func checkLaunchPath(launchPath string) error {
+	u, err := url.Parse(launchPath)
+	if err != nil {
+		return err
+	}
+	if u.IsAbs() || u.Host != "" || strings.HasPrefix(launchPath, "/") {
+		return fmt.Errorf("launch_path must be relative %s", launchPath)
+	}
+	return nil
+}
+
+func extensionKey(providerUri string) string {
+	return "extension " + providerUri
+}
+
+func (ext *Extension) launchPath() string {
+	if ext.LaunchPath != "" {
+		return ext.LaunchPath
+	}
+	return defaultLaunchPath
+}
+func (ext *Extension) allowsIssuer(iss string) bool {
+	if check.ContainsAny(ext.Unreadable, "allowed_issuers") {
+		return false
+	}
+	return len(ext.AllowedIssuers) == 0 || check.ContainsAny(ext.AllowedIssuers, iss)
+}
+func (ext *Extension) filterClaims(claims jwt.MapClaims) jwt.MapClaims {
+	filtered := make(jwt.MapClaims)
+	if check.ContainsAny(ext.Unreadable, "forward_claims") || check.ContainsAny(ext.Unreadable, "drop_claims") {
+		return filtered
+	}
+	for k, v := range claims {
+		if len(ext.ForwardClaims) > 0 && !check.ContainsAny(ext.ForwardClaims, k) {
+			continue
+		}
+		if check.ContainsAny(ext.DropClaims, k) {
+			continue
+		}
+		filtered[k] = v
+	}
+	return filtered
+}
@@ -0,0 +1,145 @@
+package run
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestParseExtension(t *testing.T) {
+	const provider = "tool.example.com"
+	tests := []struct {
+		name    string
+		body    string
+		want    *Extension
+		wantErr bool
+	}{
+		{
+			name: "no block",
+			body: `{"client_name":"tool"}`,
+			want: &Extension{},
+		},
+		{
+			name: "all fields",
+			body: `{"https://lti.run/config":{"launch_path":"app/launch","launch_mode":"form_post","forward_claims":["sub"],"drop_claims":["email"],"allowed_issuers":["https://lms.example.com"],"webhooks":{"approval":"https://tool.example.com/approve","outbox":"https://tool.example.com/outbox"},"cors_origins":["https://tool.example.com"],"scopes":["` + scopeScore + `"]}}`,
+			want: &Extension{
+				LaunchPath:     "app/launch",
+				LaunchMode:     LaunchFormPost,
+				ForwardClaims:  []string{"sub"},
+				DropClaims:     []string{"email"},
+				AllowedIssuers: []string{"https://lms.example.com"},
+				Webhooks:       ExtensionWebhooks{Approval: "https://tool.example.com/approve", Outbox: "https://tool.example.com/outbox"},
+				CorsOrigins:    []string{"https://tool.example.com"},
+				Scopes:         []string{scopeScore},
+			},
+		},
+		{
+			name:    "one bad cors origin keeps the rest",
+			body:    `{"https://lti.run/config":{"allowed_issuers":["https://lms.example.com"],"cors_origins":["https://evil.example.com","https://tool.example.com"]}}`,
+			want:    &Extension{AllowedIssuers: []string{"https://lms.example.com"}, CorsOrigins: []string{"https://tool.example.com"}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown scope keeps the allowlist",
+			body:    `{"https://lti.run/config":{"allowed_issuers":["https://lms.example.com"],"scopes":["https://example.com/scope/admin","` + scopeResultReadonly + `"]}}`,
+			want:    &Extension{AllowedIssuers: []string{"https://lms.example.com"}, Scopes: []string{scopeResultReadonly}},
+			wantErr: true,
+		},
+		{
+			name:    "absolute launch path",
+			body:    `{"https://lti.run/config":{"launch_path":"https://evil.example.com/launch","allowed_issuers":["https://lms.example.com"]}}`,
+			want:    &Extension{AllowedIssuers: []string{"https://lms.example.com"}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown launch mode",
+			body:    `{"https://lti.run/config":{"launch_mode":"redirect"}}`,
+			want:    &Extension{},
+			wantErr: true,
+		},
+		{
+			name:    "webhook on another host",
+			body:    `{"https://lti.run/config":{"webhooks":{"approval":"https://evil.example.com/approve","outbox":"https://tool.example.com/outbox"}}}`,
+			want:    &Extension{Webhooks: ExtensionWebhooks{Outbox: "https://tool.example.com/outbox"}},
+			wantErr: true,
+		},
+		{
+			name:    "unreadable allowlist",
+			body:    `{"https://lti.run/config":{"allowed_issuers":"https://lms.example.com","cors_origins":["https://tool.example.com"]}}`,
+			want:    &Extension{CorsOrigins: []string{"https://tool.example.com"}, Unreadable: []string{"allowed_issuers"}},
+			wantErr: true,
+		},
+		{
+			name:    "unreadable block",
+			body:    `{"https://lti.run/config":["allowed_issuers"]}`,
+			want:    &Extension{Unreadable: restrictingFields},
+			wantErr: true,
+		},
+		{
+			name:    "html document",
+			body:    `<!doctype html><html></html>`,
+			want:    &Extension{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseExtension(provider, []byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseExtension() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseExtension() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtensionFailsClosed(t *testing.T) {
+	tests := []struct {
+		name   string
+		ext    *Extension
+		iss    string
+		allows bool
+		claims int
+	}{
+		{"nothing declared", &Extension{}, "https://lms.example.com", true, 2},
+		{"listed issuer", &Extension{AllowedIssuers: []string{"https://lms.example.com"}}, "https://lms.example.com", true, 2},
+		{"other issuer", &Extension{AllowedIssuers: []string{"https://lms.example.com"}}, "https://other.example.com", false, 2},
+		{"unreadable issuers", &Extension{Unreadable: []string{"allowed_issuers"}}, "https://lms.example.com", false, 2},
+		{"forward claims", &Extension{ForwardClaims: []string{"sub"}}, "https://lms.example.com", true, 1},
+		{"unreadable claims", &Extension{Unreadable: []string{"drop_claims"}}, "https://lms.example.com", true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.ext.allowsIssuer(tt.iss); got != tt.allows {
+				t.Errorf("allowsIssuer(%s) = %v, want %v", tt.iss, got, tt.allows)
+			}
+			if got := tt.ext.filterClaims(jwt.MapClaims{"sub": "1", "email": "a@example.com"}); len(got) != tt.claims {
+				t.Errorf("filterClaims() = %v, want %d claims", got, tt.claims)
+			}
+		})
+	}
+}
+
+func TestParsedExtensionKeepsAllowlist(t *testing.T) {
+	api := New(newMemStore(), nil)
+	const provider = "tool.example.com"
+	doc := &toolConfigDoc{
+		Body:    []byte(`{"https://lti.run/config":{"allowed_issuers":["https://lms.example.com"]}}`),
+		Expires: time.Now().Add(time.Minute),
+	}
+	if ext := api.parsedExtension(provider, doc, nil).Ext; ext.allowsIssuer("https://other.example.com") {
+		t.Fatal("other issuer allowed")
+	}
+	// the provider is down or sent no-store
+	if ext := api.parsedExtension(provider, nil, errors.New("unreachable")).Ext; ext.allowsIssuer("https://other.example.com") {
+		t.Error("other issuer allowed after a fetch error")
+	}
+	if ext := api.cachedExtension(provider); ext.allowsIssuer("https://other.example.com") {
+		t.Error("other issuer allowed by the cached extension")
+	}
+}
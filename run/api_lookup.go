@@ -0,0 +1,116 @@
+package run
+
+import (
+	"fmt"
+
+	"github.com/rayuruno/ltirun/internal/check"
+	"github.com/rayuruno/ltirun/lti"
+)
+
+// AmbiguousLoginError lists the registrations a login without client_id could belong to,
+// only client_id and deployment ids which the platform sends in every login are shown.
+type AmbiguousLoginError struct {
+	Iss     string
+	Matches []*AmbiguousMatch
+}
+type AmbiguousMatch struct {
+	ClientId      string
+	DeploymentIds []string
+}
+
+func (e *AmbiguousLoginError) Error() string {
+	return fmt.Sprintf("ambiguous login from %s, %d registrations match, the platform must send client_id", e.Iss, len(e.Matches))
+}
+
+// loginState is kept between login and launch with the consumer resolved at login.
+type loginState struct {
+	Init       *lti.LoginInit
+	ConsumerId string
+}
+
+// matchConsumer resolves the registration of a login, client_id and lti_deployment_id are
+// optional in the third-party initiated login.
+func (api *Api) matchConsumer(providerUri string, i *lti.LoginInit) (*Consumer, error) {
+	if i.ClientId != "" {
+		return api.loadConsumer(providerUri, i.Iss, i.ClientId, i.DeploymentId)
+	}
+	var matches, deployed []*Consumer
+	for _, c := range api.issuerConsumers(providerUri, i.Iss, i.DeploymentId) {
+		matches = append(matches, c)
+		if i.DeploymentId != "" && check.ContainsAny(c.DeploymentIds, i.DeploymentId) {
+			deployed = append(deployed, c)
+		}
+	}
+	if len(deployed) > 0 {
+		matches = deployed
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("unknown registration %s", consumerId(providerUri, i.Iss, ""))
+	case 1:
+		return matches[0], nil
+	}
+	e := &AmbiguousLoginError{Iss: i.Iss}
+	for _, c := range matches {
+		e.Matches = append(e.Matches, &AmbiguousMatch{ClientId: c.Tool.ClientId, DeploymentIds: c.DeploymentIds})
+	}
+	return nil, e
+}
+
+// issuerConsumers reads the issuer index, when no entry matches the issuer and deployment
+// the registrations stored before the index existed are found through the provider's
+// consumers and indexed.
+func (api *Api) issuerConsumers(providerUri, iss, deploymentId string) []*Consumer {
+	var list []*Consumer
+	matched := false
+	for _, id := range index(api.st, issuerIndex(providerUri, iss)) {
+		if c, err := get[Consumer](api.st, id); err == nil && c.Platform.Issuer == iss {
+			list = append(list, c)
+			matched = matched || deploymentId == "" || check.ContainsAny(c.DeploymentIds, deploymentId)
+		}
+	}
+	if matched {
+		return list
+	}
+	for _, id := range index(api.st, consumersIndex(providerUri)) {
+		c, err := get[Consumer](api.st, id)
+		if err != nil || c.Platform.Issuer != iss || c.Tool == nil || containsConsumer(list, c.Id) {
+			continue
+		}
+		deploymentId := ""
+		if c.Tool.Tool != nil {
+			deploymentId = c.Tool.DeploymentId
+		}
+		if c, err = api.loadConsumer(providerUri, iss, c.Tool.ClientId, deploymentId); err != nil {
+			continue
+		}
+		if api.indexConsumer(providerUri, c) == nil {
+			list = append(list, c)
+		}
+	}
+	return list
+}
+func containsConsumer(list []*Consumer, id string) bool {
+	for _, c := range list {
+		if c.Id == id {
+			return true
+		}
+	}
+	return false
+}
+func (api *Api) indexConsumer(providerUri string, c *Consumer) error {
+	if err := api.addIndex(consumersIndex(providerUri), c.Id); err != nil {
+		return err
+	}
+	return api.addIndex(issuerIndex(providerUri, c.Platform.Issuer), c.Id)
+}
+func (api *Api) unindexConsumer(providerUri string, c *Consumer) error {
+	if err := api.removeIndex(consumersIndex(providerUri), c.Id); err != nil {
+		return err
+	}
+	return api.removeIndex(issuerIndex(providerUri, c.Platform.Issuer), c.Id)
+}
+
+func issuerIndex(providerUri, iss string) string {
+	return "issuers " + providerUri + " " + iss
+}
@@ -0,0 +1,73 @@
+package run
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rayuruno/ltirun/lti"
+)
+
+func TestMatchConsumer(t *testing.T) {
+	const (
+		provider = "tool.example.com"
+		iss      = "https://lms.example.com"
+	)
+	tests := []struct {
+		name          string
+		unindexed     bool
+		i             lti.LoginInit
+		want          string
+		wantAmbiguous []string
+		wantErr       bool
+	}{
+		{"client_id", false, lti.LoginInit{Iss: iss, ClientId: "client2"}, "client2", nil, false},
+		{"deployment of one registration", false, lti.LoginInit{Iss: iss, DeploymentId: "2"}, "client2", nil, false},
+		{"deployment of both registrations", false, lti.LoginInit{Iss: iss, DeploymentId: "shared"}, "", []string{"client1", "client2"}, true},
+		{"no deployment", false, lti.LoginInit{Iss: iss}, "", []string{"client1", "client2"}, true},
+		{"unknown deployment", false, lti.LoginInit{Iss: iss, DeploymentId: "3"}, "", []string{"client1", "client2"}, true},
+		{"unknown issuer", false, lti.LoginInit{Iss: "https://other.example.com"}, "", nil, true},
+		{"stored before the issuer index", true, lti.LoginInit{Iss: iss, DeploymentId: "1"}, "client1", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := New(newMemStore(), nil)
+			for _, d := range []string{"1", "2"} {
+				c := &Consumer{
+					Id:            consumerId(provider, iss, "client"+d),
+					Tool:          &lti.Registration{ClientId: "client" + d},
+					Platform:      &lti.Platform{Issuer: iss},
+					DeploymentIds: []string{d, "shared"},
+				}
+				set(api.st, c.Id, c, 0)
+				if tt.unindexed {
+					api.addIndex(consumersIndex(provider), c.Id)
+				} else {
+					api.indexConsumer(provider, c)
+				}
+			}
+			i := tt.i
+			c, err := api.matchConsumer(provider, &i)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("matchConsumer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && c.Tool.ClientId != tt.want {
+				t.Errorf("matchConsumer() = %s, want %s", c.Tool.ClientId, tt.want)
+			}
+			var ambiguous *AmbiguousLoginError
+			var got []string
+			if errors.As(err, &ambiguous) {
+				for _, m := range ambiguous.Matches {
+					got = append(got, m.ClientId)
+				}
+			}
+			if !equalStrings(got, tt.wantAmbiguous) {
+				t.Errorf("ambiguous %v, want %v", got, tt.wantAmbiguous)
+			}
+			if tt.unindexed {
+				if ids := index(api.st, issuerIndex(provider, iss)); len(ids) != 2 {
+					t.Errorf("issuer index %v, want both registrations", ids)
+				}
+			}
+		})
+	}
+}
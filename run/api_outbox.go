@@ -0,0 +1,284 @@
+package run
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/carlmjohnson/requests"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rayuruno/ltirun/lti"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+	OutboxFailed  = "failed"
+
+	outboxRetention   = time.Hour * 24 * 7
+	outboxMaxAttempts = 10
+	outboxMaxBackoff  = time.Hour * 1
+)
+
+// OutboxItem is a score submission waiting to be delivered to the platform, the score is
+// dropped once it is delivered or failed.
+type OutboxItem struct {
+	Id          string
+	ProviderUri string
+	ConsumerId  string
+	Request     *lti.ServiceRequest
+	Status      string
+	Attempts    int
+	LastError   string
+	NextAttempt time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+type OutboxStatus struct {
+	Id        string    `json:"id"`
+	Status    string    `json:"status"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	Endpoint  string    `json:"endpoint"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (o *OutboxItem) Summary() *OutboxStatus {
+	return &OutboxStatus{
+		Id:        o.Id,
+		Status:    o.Status,
+		Attempts:  o.Attempts,
+		LastError: o.LastError,
+		Endpoint:  o.Request.Endpoint,
+		CreatedAt: o.CreatedAt,
+		UpdatedAt: o.UpdatedAt,
+	}
+}
+
+// EnqueueScore writes a score submission to the outbox, a submission with the same
+// lineitem, user and timestamp is only queued once.
+func (api *Api) EnqueueScore(providerUri string, s *Session, r *lti.ServiceRequest) (*OutboxItem, error) {
+	if !strings.Contains(r.Scope, scopeScore) || r.Method != http.MethodPost {
+		return nil, fmt.Errorf("only score submissions can be queued")
+	}
+	endpoint, err := url.Parse(r.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(endpoint.Path, "/scores") {
+		return nil, fmt.Errorf("only score submissions can be queued")
+	}
+	if r.Callback == "" {
+		r.Callback = api.extension(providerUri).Webhooks.Outbox
+	}
+	if r.Callback != "" {
+		if err := checkProviderUrl(providerUri, r.Callback); err != nil {
+			return nil, err
+		}
+	}
+	score := struct {
+		UserId    any `json:"userId"`
+		Timestamp any `json:"timestamp"`
+	}{}
+	if err := json.Unmarshal(r.Body, &score); err != nil {
+		return nil, err
+	}
+	if score.UserId == nil || score.Timestamp == nil {
+		return nil, fmt.Errorf("score userId and timestamp required")
+	}
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/scores")
+	id := hashid(fmt.Sprint(endpoint.String(), " ", score.UserId, " ", score.Timestamp))
+
+	v, err := api.fl.Do(outboxKey(id), func() (any, error) {
+		if o, err := get[OutboxItem](api.st, outboxKey(id)); err == nil {
+			return o, nil
+		}
+		now := time.Now().UTC()
+		o := &OutboxItem{
+			Id:          id,
+			ProviderUri: providerUri,
+			ConsumerId:  s.Consumer.Id,
+			Request:     r,
+			Status:      OutboxPending,
+			NextAttempt: now,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+		if err := set(api.st, outboxKey(id), o, outboxRetention); err != nil {
+			return nil, err
+		}
+		return o, api.st.Set(outboxPendingKey(id), s2b(id), outboxRetention)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*OutboxItem), nil
+}
+func (api *Api) GetOutboxItem(providerUri, id string) (*OutboxItem, error) {
+	o, err := get[OutboxItem](api.st, outboxKey(id))
+	if err != nil || o.ProviderUri != providerUri {
+		return nil, fmt.Errorf("unknown outbox item %s", id)
+	}
+	return o, nil
+}
+
+// RunOutbox delivers due outbox items until ctx is done.
+func (api *Api) RunOutbox(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			api.processOutbox()
+		}
+	}
+}
+func (api *Api) processOutbox() {
+	keys, err := api.st.Keys(outboxPendingKey(""))
+	if err != nil {
+		log.Error().Err(err).Msg("outbox")
+		return
+	}
+	for _, k := range keys {
+		id := strings.TrimPrefix(k, outboxPendingKey(""))
+		o, err := get[OutboxItem](api.st, outboxKey(id))
+		if err != nil || o.Status != OutboxPending {
+			api.st.Delete(k)
+			continue
+		}
+		if time.Now().Before(o.NextAttempt) {
+			continue
+		}
+		api.deliverOutboxItem(o)
+	}
+}
+
+// deleteOutboxItems drops the pending items of a deleted consumer.
+func (api *Api) deleteOutboxItems(consumerId string) {
+	keys, _ := api.st.Keys(outboxPendingKey(""))
+	for _, k := range keys {
+		id := strings.TrimPrefix(k, outboxPendingKey(""))
+		if o, err := get[OutboxItem](api.st, outboxKey(id)); err == nil && o.ConsumerId != consumerId {
+			continue
+		}
+		api.st.Delete(outboxKey(id))
+		api.st.Delete(k)
+	}
+}
+func (api *Api) deliverOutboxItem(o *OutboxItem) {
+	err := api.sendOutboxItem(o)
+	now := time.Now().UTC()
+	o.Attempts++
+	o.UpdatedAt = now
+	switch {
+	case err == nil:
+		o.Status = OutboxSent
+		o.LastError = ""
+	case o.Attempts >= outboxMaxAttempts:
+		o.Status = OutboxFailed
+		o.LastError = err.Error()
+	default:
+		o.LastError = err.Error()
+		o.NextAttempt = now.Add(outboxBackoff(o.Attempts))
+	}
+	if o.Status != OutboxPending {
+		o.Request.Body = nil
+	}
+	if err != nil {
+		log.Error().Err(err).Str("id", o.Id).Int("attempts", o.Attempts).Msg("outbox")
+	}
+	if err := set(api.st, outboxKey(o.Id), o, outboxRetention); err != nil {
+		log.Error().Err(err).Str("id", o.Id).Msg("outbox")
+		return
+	}
+	if o.Status != OutboxPending {
+		api.st.Delete(outboxPendingKey(o.Id))
+		if err := api.notifyOutbox(o); err != nil {
+			log.Error().Err(err).Str("id", o.Id).Msg("outbox callback")
+		}
+	}
+}
+func (api *Api) sendOutboxItem(o *OutboxItem) error {
+	c, err := get[Consumer](api.st, o.ConsumerId)
+	if err != nil {
+		return err
+	}
+	// the request was checked against the launch when it was queued
+	s := &Session{Id: o.Id, Consumer: c}
+	a := new(lti.AccessToken)
+	if err := api.GetAccessToken(s, o.Request, a); err != nil {
+		return err
+	}
+	b := ""
+	return api.SendServiceRequest(a, o.Request, &b)
+}
+func (api *Api) notifyOutbox(o *OutboxItem) error {
+	if o.Request.Callback == "" {
+		return nil
+	}
+	c, err := get[Consumer](api.st, o.ConsumerId)
+	if err != nil {
+		return err
+	}
+	token, err := api.ks.Sign(jwt.RegisteredClaims{
+		Issuer:    c.Tool.Domain,
+		Subject:   o.Id,
+		Audience:  jwt.ClaimStrings{o.Request.Callback},
+		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(time.Minute * 5)),
+	}, c.Id)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*1)
+	defer cancel()
+
+	return requests.
+		URL(o.Request.Callback).
+		Method(http.MethodPost).
+		Bearer(token).
+		BodyJSON(o.Summary()).
+		Fetch(ctx)
+}
+
+func outboxKey(id string) string {
+	return "outbox " + id
+}
+
+func outboxPendingKey(id string) string {
+	return "pending outbox " + id
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	d := time.Second * 10 << attempts
+	if d <= 0 || d > outboxMaxBackoff {
+		return outboxMaxBackoff
+	}
+	return d
+}
+
+// checkProviderUrl only allows urls on the provider's host.
+func checkProviderUrl(providerUri, rawUrl string) error {
+	provUrl, err := providerUrl(providerUri)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != provUrl.Scheme || u.Hostname() != provUrl.Hostname() {
+		return fmt.Errorf("host mismatch %s %s", providerUri, rawUrl)
+	}
+	return nil
+}
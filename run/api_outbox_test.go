@@ -0,0 +1,126 @@
+package run
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rayuruno/ltirun/lti"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, time.Second * 10},
+		{1, time.Second * 20},
+		{3, time.Second * 80},
+		{8, time.Second * 2560},
+		{9, outboxMaxBackoff},
+		{outboxMaxAttempts, outboxMaxBackoff},
+		{64, outboxMaxBackoff},
+	}
+	for _, tt := range tests {
+		if got := outboxBackoff(tt.attempts); got != tt.want {
+			t.Errorf("outboxBackoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestEnqueueScore(t *testing.T) {
+	const (
+		provider = "tool.example.com"
+		lineitem = "https://lms.example.com/api/lti/courses/1/line_items/2"
+	)
+	score := func(userId, timestamp string) lti.ServiceRequest {
+		return lti.ServiceRequest{
+			Scope:    scopeScore,
+			Method:   http.MethodPost,
+			Endpoint: lineitem + "/scores",
+			Body:     json.RawMessage(`{"userId":"` + userId + `","timestamp":"` + timestamp + `","scoreGiven":1}`),
+			Callback: "https://tool.example.com/outbox",
+		}
+	}
+	tests := []struct {
+		name    string
+		r       lti.ServiceRequest
+		sameAs  int
+		wantErr bool
+	}{
+		{"first", score("1", "2024-01-01T00:00:00Z"), -1, false},
+		{"same score", score("1", "2024-01-01T00:00:00Z"), 0, false},
+		{"other user", score("2", "2024-01-01T00:00:00Z"), -1, false},
+		{"other timestamp", score("1", "2024-01-02T00:00:00Z"), -1, false},
+		{"not a score", lti.ServiceRequest{Scope: scopeLineItem, Method: http.MethodGet, Endpoint: lineitem}, -1, true},
+		{"not a scores url", func() lti.ServiceRequest { r := score("1", "2024-01-01T00:00:00Z"); r.Endpoint = lineitem; return r }(), -1, true},
+		{"no user", func() lti.ServiceRequest {
+			r := score("1", "x")
+			r.Body = json.RawMessage(`{"timestamp":"x"}`)
+			return r
+		}(), -1, true},
+		{"callback on other host", func() lti.ServiceRequest { r := score("3", "x"); r.Callback = "https://evil.example.com"; return r }(), -1, true},
+	}
+	api := New(newMemStore(), nil)
+	s := &Session{Consumer: &Consumer{Id: provider + " https://lms.example.com client"}}
+	var ids []string
+	for i, tt := range tests {
+		r := tt.r
+		o, err := api.EnqueueScore(provider, s, &r)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%s: EnqueueScore() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+		if err != nil {
+			ids = append(ids, "")
+			continue
+		}
+		ids = append(ids, o.Id)
+		if tt.sameAs >= 0 && o.Id != ids[tt.sameAs] {
+			t.Errorf("%s: queued again as %s", tt.name, o.Id)
+		}
+		for j := 0; j < i; j++ {
+			if tt.sameAs != j && ids[j] == o.Id {
+				t.Errorf("%s: deduplicated with %s", tt.name, tests[j].name)
+			}
+		}
+	}
+	keys, _ := api.st.Keys(outboxPendingKey(""))
+	if len(keys) != 3 {
+		t.Errorf("%d pending items, want 3", len(keys))
+	}
+}
+
+func TestDeliverOutboxItem(t *testing.T) {
+	api := New(newMemStore(), nil)
+	o := &OutboxItem{
+		Id:          "1",
+		ProviderUri: "tool.example.com",
+		ConsumerId:  "unknown",
+		Request:     &lti.ServiceRequest{Endpoint: "https://lms.example.com/scores", Body: json.RawMessage(`{"userId":"1"}`)},
+		Status:      OutboxPending,
+	}
+	api.st.Set(outboxPendingKey(o.Id), s2b(o.Id), 0)
+	api.deliverOutboxItem(o)
+	if o.Status != OutboxPending || o.Attempts != 1 || o.Request.Body == nil {
+		t.Fatalf("after one failure %+v", o)
+	}
+	if b, _ := api.st.Get(outboxPendingKey(o.Id)); b == nil {
+		t.Fatal("retry not pending")
+	}
+	o.Attempts = outboxMaxAttempts - 1
+	api.deliverOutboxItem(o)
+	if o.Status != OutboxFailed {
+		t.Fatalf("status %s, want %s", o.Status, OutboxFailed)
+	}
+	stored, err := get[OutboxItem](api.st, outboxKey(o.Id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := string(stored.Request.Body); b != "" && b != "null" {
+		t.Errorf("score kept after giving up %s", stored.Request.Body)
+	}
+	if b, _ := api.st.Get(outboxPendingKey(o.Id)); b != nil {
+		t.Error("failed item still pending")
+	}
+}
@@ -0,0 +1,153 @@
+package run
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	PolicyConnect  = "connect"
+	PolicyRegister = "register"
+	PolicyLogin    = "login"
+	PolicyLaunch   = "launch"
+
+	auditMax       = 200
+	auditRetention = time.Hour * 24 * 30
+)
+
+// Policy decides which platforms may register and launch the provider, deny rules win and
+// a non empty allow list rejects everything else.
+type Policy struct {
+	Allow []PolicyRule `json:"allow,omitempty"`
+	Deny  []PolicyRule `json:"deny,omitempty"`
+}
+
+// PolicyRule matches when all of its set fields match. Issuer is a glob matched against the
+// issuer url, or against its host when the pattern has no scheme, e.g. *.instructure.com.
+// DeploymentId is not known before the first launch, an allow rule matches any deployment
+// until then and a deny rule none.
+type PolicyRule struct {
+	Issuer        string `json:"issuer,omitempty"`
+	ProductFamily string `json:"product_family,omitempty"`
+	DeploymentId  string `json:"deployment_id,omitempty"`
+}
+
+// PolicyError is returned when the provider's policy rejects a platform.
+type PolicyError struct {
+	Stage  string
+	Issuer string
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("%s from %s not allowed by the tool provider, %s", e.Stage, e.Issuer, e.Reason)
+}
+
+// AuditEntry records a rejected attempt.
+type AuditEntry struct {
+	Time          time.Time `json:"time"`
+	Stage         string    `json:"stage"`
+	Issuer        string    `json:"issuer"`
+	ProductFamily string    `json:"product_family,omitempty"`
+	DeploymentId  string    `json:"deployment_id,omitempty"`
+	ClientId      string    `json:"client_id,omitempty"`
+	Reason        string    `json:"reason"`
+}
+
+// checkPolicy evaluates the provider's allowed issuers and policy, rejections are audited.
+func (api *Api) checkPolicy(providerUri, stage string, e *AuditEntry) error {
+	reason := ""
+	policy := api.GetSettings(providerUri).Policy
+	switch {
+	case !api.extension(providerUri).allowsIssuer(e.Issuer):
+		reason = "issuer not in allowed_issuers"
+	case policy == nil:
+	case policy.matches(policy.Deny, e, false):
+		reason = "denied by policy"
+	case len(policy.Allow) > 0 && !policy.matches(policy.Allow, e, true):
+		reason = "not in the policy allow list"
+	}
+	if reason == "" {
+		return nil
+	}
+	e.Time = time.Now().UTC()
+	e.Stage = stage
+	e.Reason = reason
+	if err := api.audit(providerUri, e); err != nil {
+		return err
+	}
+	return &PolicyError{Stage: stage, Issuer: e.Issuer, Reason: reason}
+}
+func (api *Api) audit(providerUri string, e *AuditEntry) error {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	entries, _ := get[[]*AuditEntry](api.st, auditKey(providerUri))
+	if entries == nil {
+		entries = new([]*AuditEntry)
+	}
+	list := append(*entries, e)
+	if len(list) > auditMax {
+		list = list[len(list)-auditMax:]
+	}
+	return set(api.st, auditKey(providerUri), list, auditRetention)
+}
+
+// AuditLog lists the provider's rejected attempts, oldest first.
+func (api *Api) AuditLog(providerUri string) []*AuditEntry {
+	entries, err := get[[]*AuditEntry](api.st, auditKey(providerUri))
+	if err != nil {
+		return []*AuditEntry{}
+	}
+	return *entries
+}
+
+func (p *Policy) validate() error {
+	for _, r := range append(append([]PolicyRule{}, p.Allow...), p.Deny...) {
+		if r.Issuer == "" && r.ProductFamily == "" && r.DeploymentId == "" {
+			return fmt.Errorf("empty policy rule")
+		}
+		if _, err := path.Match(r.Issuer, ""); err != nil {
+			return fmt.Errorf("invalid issuer pattern %q", r.Issuer)
+		}
+	}
+	return nil
+}
+func (p *Policy) matches(rules []PolicyRule, e *AuditEntry, allow bool) bool {
+	for _, r := range rules {
+		if r.matches(e, allow) {
+			return true
+		}
+	}
+	return false
+}
+func (r *PolicyRule) matches(e *AuditEntry, allow bool) bool {
+	if r.Issuer != "" && !matchIssuer(r.Issuer, e.Issuer) {
+		return false
+	}
+	if r.ProductFamily != "" && !strings.EqualFold(r.ProductFamily, e.ProductFamily) {
+		return false
+	}
+	if e.DeploymentId == "" {
+		return r.DeploymentId == "" || allow
+	}
+	return r.DeploymentId == "" || r.DeploymentId == e.DeploymentId
+}
+
+func matchIssuer(pattern, iss string) bool {
+	if !strings.Contains(pattern, "://") {
+		u, err := url.Parse(iss)
+		if err != nil {
+			return false
+		}
+		iss = u.Hostname()
+	}
+	ok, _ := path.Match(pattern, iss)
+	return ok
+}
+
+func auditKey(providerUri string) string {
+	return "audit " + providerUri
+}
@@ -0,0 +1,79 @@
+package run
+
+import "testing"
+
+func TestMatchIssuer(t *testing.T) {
+	tests := []struct {
+		pattern string
+		iss     string
+		want    bool
+	}{
+		{"*.instructure.com", "https://school.instructure.com", true},
+		{"*.instructure.com", "https://instructure.com", false},
+		{"*.instructure.com", "https://school.instructure.com.evil.com", false},
+		{"*.instructure.com", "https://evil.com/school.instructure.com", false},
+		{"canvas.instructure.com", "https://canvas.instructure.com:443", true},
+		{"https://moodle.example.com", "https://moodle.example.com", true},
+		{"https://moodle.example.com", "http://moodle.example.com", false},
+		{"https://moodle.example.com", "https://moodle.example.com/other", false},
+		{"https://moodle.example.com/*", "https://moodle.example.com/site", true},
+		{"https://*.example.com", "https://a.example.com", true},
+		{"https://*.example.com", "https://a.b/example.com", false},
+		{"[", "https://moodle.example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.iss, func(t *testing.T) {
+			if got := matchIssuer(tt.pattern, tt.iss); got != tt.want {
+				t.Errorf("matchIssuer(%q, %q) = %v, want %v", tt.pattern, tt.iss, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyRuleMatches(t *testing.T) {
+	const iss = "https://school.instructure.com"
+	tests := []struct {
+		name  string
+		rule  PolicyRule
+		entry AuditEntry
+		allow bool
+		want  bool
+	}{
+		{"issuer", PolicyRule{Issuer: "*.instructure.com"}, AuditEntry{Issuer: iss}, true, true},
+		{"product family any case", PolicyRule{ProductFamily: "Canvas"}, AuditEntry{Issuer: iss, ProductFamily: "canvas"}, true, true},
+		{"all fields must match", PolicyRule{Issuer: "*.instructure.com", ProductFamily: "moodle"}, AuditEntry{Issuer: iss, ProductFamily: "canvas"}, true, false},
+		{"deployment", PolicyRule{DeploymentId: "1"}, AuditEntry{Issuer: iss, DeploymentId: "1"}, true, true},
+		{"other deployment", PolicyRule{DeploymentId: "1"}, AuditEntry{Issuer: iss, DeploymentId: "2"}, true, false},
+		{"allow deployment not yet known", PolicyRule{DeploymentId: "1"}, AuditEntry{Issuer: iss}, true, true},
+		{"deny deployment not yet known", PolicyRule{DeploymentId: "1"}, AuditEntry{Issuer: iss}, false, false},
+		{"deny issuer before deployment known", PolicyRule{Issuer: "*.instructure.com"}, AuditEntry{Issuer: iss}, false, true},
+		{"allow deployment of other issuer", PolicyRule{Issuer: "moodle.example.com", DeploymentId: "1"}, AuditEntry{Issuer: iss}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.matches(&tt.entry, tt.allow); got != tt.want {
+				t.Errorf("matches(%+v, %v) = %v, want %v", tt.entry, tt.allow, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  Policy
+		wantErr bool
+	}{
+		{"empty", Policy{}, false},
+		{"rules", Policy{Allow: []PolicyRule{{Issuer: "*.instructure.com"}}, Deny: []PolicyRule{{DeploymentId: "1"}}}, false},
+		{"empty rule", Policy{Deny: []PolicyRule{{}}}, true},
+		{"bad pattern", Policy{Allow: []PolicyRule{{Issuer: "["}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
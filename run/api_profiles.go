@@ -0,0 +1,158 @@
+package run
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rayuruno/ltirun/internal/check"
+	"github.com/rayuruno/ltirun/lti"
+)
+
+// Profile adjusts login, launch and token requests to a platform's reading of the spec.
+type Profile struct {
+	Name string `json:"name"`
+	// LegacyDeploymentId reads deployment_id when lti_deployment_id is missing from the login
+	LegacyDeploymentId bool `json:"legacy_deployment_id,omitempty"`
+	// TrimIssuerSlash treats issuers with and without trailing slash as equal
+	TrimIssuerSlash bool `json:"trim_issuer_slash,omitempty"`
+	// AllowMissingAzp accepts id_tokens with multiple audiences but no azp
+	AllowMissingAzp bool `json:"allow_missing_azp,omitempty"`
+	// TokenAudience of the client assertion, defaults to the token endpoint
+	TokenAudience string `json:"token_audience,omitempty"`
+	// OmitPrompt leaves prompt=none out of the authentication request
+	OmitPrompt bool `json:"omit_prompt,omitempty"`
+}
+
+const defaultProfile = "default"
+
+// profiles are keyed by the lowercase product_family_code.
+var profiles = map[string]*Profile{
+	defaultProfile: {Name: defaultProfile},
+	"canvas":       {Name: "canvas"},
+	"moodle":       {Name: "moodle", LegacyDeploymentId: true, TrimIssuerSlash: true},
+	"blackboardlearn": {
+		Name:            "blackboardlearn",
+		AllowMissingAzp: true,
+		OmitPrompt:      true,
+	},
+	"desire2learn": {
+		Name:          "desire2learn",
+		TokenAudience: "https://api.brightspace.com/auth/token",
+	},
+	"sakai": {Name: "sakai", LegacyDeploymentId: true, TrimIssuerSlash: true},
+}
+
+// ProfileNames lists the known platform profiles.
+func ProfileNames() []string {
+	names := make([]string, 0, len(profiles))
+	for k := range profiles {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// profile is set manually on the consumer or follows the platform's product family.
+func (c *Consumer) profile() *Profile {
+	if p, ok := profiles[c.Profile]; ok {
+		return p
+	}
+	if p, ok := profiles[strings.ToLower(c.Platform.ProductFamilyCode)]; ok {
+		return p
+	}
+	return profiles[defaultProfile]
+}
+
+func checkProfile(name string) error {
+	if _, ok := profiles[name]; name != "" && !ok {
+		return fmt.Errorf("unknown profile %q", name)
+	}
+	return nil
+}
+
+func (p *Profile) deploymentId(i *lti.LoginInit) string {
+	if i.DeploymentId == "" && p.LegacyDeploymentId {
+		return i.LegacyDeploymentId
+	}
+	return i.DeploymentId
+}
+func (p *Profile) prompt() string {
+	if p.OmitPrompt {
+		return ""
+	}
+	return "none"
+}
+func (p *Profile) sameIssuer(a, b string) bool {
+	if p.TrimIssuerSlash {
+		return strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/")
+	}
+	return a == b
+}
+func (p *Profile) tokenAudience(c *Consumer) string {
+	if p.TokenAudience != "" {
+		return p.TokenAudience
+	}
+	return c.Platform.TokenEndpoint
+}
+
+// checkIdToken verifies iss, aud and azp of the id_token against the registration.
+func (p *Profile) checkIdToken(c *Consumer, claims jwt.MapClaims) error {
+	iss, err := claims.GetIssuer()
+	if err != nil {
+		return err
+	}
+	if !p.sameIssuer(iss, c.Platform.Issuer) {
+		return fmt.Errorf("invalid issuer %s", iss)
+	}
+	aud, err := claims.GetAudience()
+	if err != nil {
+		return err
+	}
+	if !check.ContainsAny(aud, c.Tool.ClientId) {
+		return fmt.Errorf("invalid audience %s", aud)
+	}
+	azp, _ := claims["azp"].(string)
+	switch {
+	case azp != "" && azp != c.Tool.ClientId:
+		return fmt.Errorf("invalid azp %s", azp)
+	case azp == "" && len(aud) > 1 && !p.AllowMissingAzp:
+		return fmt.Errorf("azp required with multiple audiences")
+	}
+	return nil
+}
+
+// findConsumer looks up the legacy deployment_id first, the match is kept only when its
+// profile reads deployment_id.
+func (api *Api) findConsumer(providerUri string, i *lti.LoginInit) (*Consumer, error) {
+	if i.DeploymentId == "" && i.LegacyDeploymentId != "" {
+		legacy := *i
+		legacy.DeploymentId = i.LegacyDeploymentId
+		if c, err := api.findIssuerConsumer(providerUri, &legacy); err == nil && c.profile().LegacyDeploymentId {
+			return c, nil
+		}
+	}
+	return api.findIssuerConsumer(providerUri, i)
+}
+
+// findIssuerConsumer retries the lookup with the issuer's trailing slash toggled for
+// profiles which allow it.
+func (api *Api) findIssuerConsumer(providerUri string, i *lti.LoginInit) (*Consumer, error) {
+	c, err := api.matchConsumer(providerUri, i)
+	var ambiguous *AmbiguousLoginError
+	if err == nil || errors.As(err, &ambiguous) || i.Iss == "" {
+		return c, err
+	}
+	alt := *i
+	if strings.HasSuffix(i.Iss, "/") {
+		alt.Iss = strings.TrimSuffix(i.Iss, "/")
+	} else {
+		alt.Iss = i.Iss + "/"
+	}
+	if c, aerr := api.matchConsumer(providerUri, &alt); aerr == nil && c.profile().TrimIssuerSlash {
+		return c, nil
+	}
+	return nil, err
+}
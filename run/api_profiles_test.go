@@ -0,0 +1,55 @@
+package run
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rayuruno/ltirun/lti"
+)
+
+func TestFindConsumerLegacyDeployment(t *testing.T) {
+	const (
+		provider = "tool.example.com"
+		iss      = "https://lms.example.com"
+	)
+	tests := []struct {
+		name    string
+		profile string
+		i       lti.LoginInit
+		want    string
+		wantErr bool
+	}{
+		{"legacy deployment_id", "moodle", lti.LoginInit{Iss: iss, LegacyDeploymentId: "2"}, "client2", false},
+		{"legacy deployment_id with client_id", "moodle", lti.LoginInit{Iss: iss, ClientId: "client1", LegacyDeploymentId: "1"}, "client1", false},
+		{"lti_deployment_id wins", "moodle", lti.LoginInit{Iss: iss, DeploymentId: "1", LegacyDeploymentId: "2"}, "client1", false},
+		{"ignored by other profiles", "", lti.LoginInit{Iss: iss, LegacyDeploymentId: "2"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := New(newMemStore(), nil)
+			for _, d := range []string{"1", "2"} {
+				c := &Consumer{
+					Id:            consumerId(provider, iss, "client"+d),
+					Tool:          &lti.Registration{ClientId: "client" + d},
+					Platform:      &lti.Platform{Issuer: iss},
+					DeploymentIds: []string{d},
+					Profile:       tt.profile,
+				}
+				set(api.st, c.Id, c, 0)
+				api.indexConsumer(provider, c)
+			}
+			i := tt.i
+			c, err := api.findConsumer(provider, &i)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("findConsumer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var ambiguous *AmbiguousLoginError
+			if tt.wantErr && !errors.As(err, &ambiguous) {
+				t.Errorf("findConsumer() error = %v, want ambiguous", err)
+			}
+			if err == nil && c.Tool.ClientId != tt.want {
+				t.Errorf("findConsumer() = %s, want %s", c.Tool.ClientId, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package run
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rayuruno/ltirun/internal/check"
+	"github.com/rayuruno/ltirun/lti"
+)
+
+const (
+	contextClaim      = "https://purl.imsglobal.org/spec/lti/claim/context"
+	resourceLinkClaim = "https://purl.imsglobal.org/spec/lti/claim/resource_link"
+	deploymentIdClaim = "https://purl.imsglobal.org/spec/lti/claim/deployment_id"
+	providerTokenLife = time.Minute * 5
+	launchTokenLife   = time.Hour * 2
+	// launchContextRetention is refreshed by every launch of the resource link or context
+	launchContextRetention = time.Hour * 24 * 180
+)
+
+// LaunchContext keeps the service endpoints of the latest launch of a resource link or context.
+type LaunchContext struct {
+	ConsumerId     string
+	Iss            string
+	ClientId       string
+	DeploymentId   string
+	ContextId      string
+	ResourceLinkId string
+	Scopes         []string
+	Endpoints      map[string]map[string]any
+	UpdatedAt      time.Time
+}
+
+// VerifyProvider checks a token signed by the keys published at the provider's own jwks_uri.
+func (api *Api) VerifyProvider(serviceUrl, providerUri, signed string) error {
+	provUrl, err := providerUrl(providerUri)
+	if err != nil {
+		return err
+	}
+	t := new(lti.Tool)
+	if err := api.fetchToolConfig(providerUri, t); err != nil {
+		return err
+	}
+	if t.JwksUri == "" {
+		return fmt.Errorf("provider jwks_uri missing")
+	}
+	if err := checkProviderUrl(providerUri, t.JwksUri); err != nil {
+		return err
+	}
+	token, err := api.ks.Verify(signed, t.JwksUri)
+	if err != nil {
+		return err
+	}
+	iss, err := token.Claims.GetIssuer()
+	if err != nil {
+		return err
+	}
+	if iss != providerUri && iss != provUrl.String() {
+		return fmt.Errorf("invalid issuer %s", iss)
+	}
+	aud, err := token.Claims.GetAudience()
+	if err != nil {
+		return err
+	}
+	if !check.ContainsAny(aud, serviceUrl) {
+		return fmt.Errorf("invalid audience %s", aud)
+	}
+	exp, err := token.Claims.GetExpirationTime()
+	if err != nil {
+		return err
+	}
+	if exp == nil || time.Until(exp.Time) > providerTokenLife {
+		return fmt.Errorf("exp must be within %s", providerTokenLife)
+	}
+	jti, _ := token.Claims.(jwt.MapClaims)["jti"].(string)
+	if jti == "" {
+		return fmt.Errorf("jti required")
+	}
+	return api.useJti(providerUri, jti, exp.Time)
+}
+
+// useJti records the jti until the token expires, a token is accepted once.
+func (api *Api) useJti(providerUri, jti string, exp time.Time) error {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	k := jtiKey(providerUri, jti)
+	used, err := api.st.Get(k)
+	if err != nil {
+		return err
+	}
+	if len(used) > 0 {
+		return fmt.Errorf("token replayed %s", jti)
+	}
+	// the leeway of the keystore accepts tokens shortly after exp
+	return api.st.Set(k, s2b("1"), time.Until(exp)+time.Minute)
+}
+func (api *Api) GetContextSession(providerUri string, r *lti.ProviderServiceRequest) (*Session, error) {
+	lc, err := api.findLaunchContext(providerUri, r)
+	if err != nil {
+		return nil, err
+	}
+	c, err := get[Consumer](api.st, lc.ConsumerId)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.active(); err != nil {
+		return nil, err
+	}
+	return &Session{Id: hashid(lc.key()), Consumer: c, Claims: lc.claims()}, nil
+}
+func (api *Api) findLaunchContext(providerUri string, r *lti.ProviderServiceRequest) (*LaunchContext, error) {
+	kind, id := "context", r.ContextId
+	if r.ResourceLinkId != "" {
+		kind, id = "link", r.ResourceLinkId
+	}
+	if id == "" {
+		return nil, fmt.Errorf("resource_link_id or context_id required")
+	}
+	var found *LaunchContext
+	for _, consumerId := range index(api.st, launchContextIndex(kind, providerUri, id)) {
+		lc, err := get[LaunchContext](api.st, launchContextKey(kind, consumerId, id))
+		if err != nil {
+			// the context expired before the index
+			api.pruneIndex(launchContextIndex(kind, providerUri, id), consumerId, launchContextRetention)
+			continue
+		}
+		if !lc.matches(r) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("ambiguous %s %s, add iss, client_id or deployment_id", kind, id)
+		}
+		found = lc
+	}
+	if found == nil {
+		return nil, fmt.Errorf("unknown %s %s", kind, id)
+	}
+	return found, nil
+}
+
+// storeLaunchContext persists the service endpoints of a launch per resource link and per context,
+// they outlive the session so providers can grade later, every launch refreshes their retention.
+func (api *Api) storeLaunchContext(providerUri string, s *Session) error {
+	contextId, _ := claimMap(s.Claims, contextClaim)["id"].(string)
+	resourceLinkId, _ := claimMap(s.Claims, resourceLinkClaim)["id"].(string)
+	deploymentId, _ := s.Claims[deploymentIdClaim].(string)
+	lc := &LaunchContext{
+		ConsumerId:     s.Consumer.Id,
+		Iss:            s.Consumer.Platform.Issuer,
+		ClientId:       s.Consumer.Tool.ClientId,
+		DeploymentId:   deploymentId,
+		ContextId:      contextId,
+		ResourceLinkId: resourceLinkId,
+		Scopes:         grantedScopes(s.Claims),
+		Endpoints:      make(map[string]map[string]any),
+		UpdatedAt:      time.Now().UTC(),
+	}
+	for _, c := range []string{agsClaim, nrpsClaim, gsClaim} {
+		if m := claimMap(s.Claims, c); m != nil {
+			lc.Endpoints[c] = m
+		}
+	}
+	if resourceLinkId != "" {
+		if err := api.putLaunchContext("link", providerUri, resourceLinkId, lc); err != nil {
+			return err
+		}
+	}
+	if contextId != "" {
+		// the lineitem belongs to the resource link, not the context
+		ctx := *lc
+		ctx.ResourceLinkId = ""
+		ctx.Endpoints = make(map[string]map[string]any)
+		for k, v := range lc.Endpoints {
+			ctx.Endpoints[k] = v
+		}
+		if ags, ok := ctx.Endpoints[agsClaim]; ok {
+			m := make(map[string]any)
+			for k, v := range ags {
+				if k != "lineitem" {
+					m[k] = v
+				}
+			}
+			ctx.Endpoints[agsClaim] = m
+		}
+		if err := api.putLaunchContext("context", providerUri, contextId, &ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func (api *Api) putLaunchContext(kind, providerUri, id string, lc *LaunchContext) error {
+	if err := set(api.st, launchContextKey(kind, lc.ConsumerId, id), lc, launchContextRetention); err != nil {
+		return err
+	}
+	return api.refreshIndex(launchContextIndex(kind, providerUri, id), lc.ConsumerId, launchContextRetention)
+}
+
+// deleteLaunchContexts removes the launch contexts of a deleted consumer.
+func (api *Api) deleteLaunchContexts(providerUri, consumerId string) {
+	for _, kind := range []string{"link", "context"} {
+		prefix := launchContextKey(kind, consumerId, "")
+		keys, _ := api.st.Keys(prefix)
+		for _, k := range keys {
+			api.st.Delete(k)
+			api.pruneIndex(launchContextIndex(kind, providerUri, strings.TrimPrefix(k, prefix)), consumerId, launchContextRetention)
+		}
+	}
+}
+
+func (lc *LaunchContext) key() string {
+	if lc.ResourceLinkId != "" {
+		return launchContextKey("link", lc.ConsumerId, lc.ResourceLinkId)
+	}
+	return launchContextKey("context", lc.ConsumerId, lc.ContextId)
+}
+func (lc *LaunchContext) matches(r *lti.ProviderServiceRequest) bool {
+	return (r.Iss == "" || r.Iss == lc.Iss) &&
+		(r.ClientId == "" || r.ClientId == lc.ClientId) &&
+		(r.DeploymentId == "" || r.DeploymentId == lc.DeploymentId) &&
+		(r.ContextId == "" || r.ContextId == lc.ContextId)
+}
+func (lc *LaunchContext) claims() jwt.MapClaims {
+	claims := jwt.MapClaims{
+		deploymentIdClaim: lc.DeploymentId,
+		contextClaim:      map[string]any{"id": lc.ContextId},
+	}
+	if lc.ResourceLinkId != "" {
+		claims[resourceLinkClaim] = map[string]any{"id": lc.ResourceLinkId}
+	}
+	for k, v := range lc.Endpoints {
+		claims[k] = v
+	}
+	return claims
+}
+
+func launchContextKey(kind, consumerId, id string) string {
+	return kind + " " + consumerId + " " + id
+}
+
+func launchContextIndex(kind, providerUri, id string) string {
+	return kind + "s " + providerUri + " " + id
+}
+
+func jtiKey(providerUri, jti string) string {
+	return "jti " + providerUri + " " + jti
+}
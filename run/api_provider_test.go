@@ -0,0 +1,94 @@
+package run
+
+import (
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rayuruno/ltirun/lti"
+)
+
+func TestLaunchContexts(t *testing.T) {
+	const provider = "tool.example.com"
+	api := New(newMemStore(), nil)
+	consumer := func(iss string) *Consumer {
+		return &Consumer{
+			Id:       consumerId(provider, iss, "client"),
+			Tool:     &lti.Registration{ClientId: "client"},
+			Platform: &lti.Platform{Issuer: iss},
+		}
+	}
+	launch := func(c *Consumer, link string) {
+		s := &Session{Consumer: c, Claims: jwt.MapClaims{
+			deploymentIdClaim: "1",
+			contextClaim:      map[string]any{"id": "course"},
+			resourceLinkClaim: map[string]any{"id": link},
+			agsClaim:          map[string]any{"lineitem": "https://lms.example.com/" + link},
+		}}
+		if err := api.storeLaunchContext(provider, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b := consumer("https://a.example.com"), consumer("https://b.example.com")
+	launch(a, "link1")
+	launch(a, "link1")
+	launch(b, "link2")
+	launch(b, "link1")
+
+	tests := []struct {
+		name    string
+		r       lti.ProviderServiceRequest
+		want    string
+		wantErr bool
+	}{
+		{"link of one consumer", lti.ProviderServiceRequest{ResourceLinkId: "link2"}, b.Id, false},
+		{"ambiguous link", lti.ProviderServiceRequest{ResourceLinkId: "link1"}, "", true},
+		{"link by issuer", lti.ProviderServiceRequest{ResourceLinkId: "link1", Iss: "https://a.example.com"}, a.Id, false},
+		{"context by issuer", lti.ProviderServiceRequest{ContextId: "course", Iss: "https://b.example.com"}, b.Id, false},
+		{"other deployment", lti.ProviderServiceRequest{ResourceLinkId: "link2", DeploymentId: "2"}, "", true},
+		{"unknown link", lti.ProviderServiceRequest{ResourceLinkId: "link3"}, "", true},
+		{"no ids", lti.ProviderServiceRequest{}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.r
+			lc, err := api.findLaunchContext(provider, &r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("findLaunchContext() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && lc.ConsumerId != tt.want {
+				t.Errorf("findLaunchContext() = %s, want %s", lc.ConsumerId, tt.want)
+			}
+		})
+	}
+
+	t.Run("context has no lineitem", func(t *testing.T) {
+		lc, err := api.findLaunchContext(provider, &lti.ProviderServiceRequest{ContextId: "course", Iss: "https://a.example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := lc.Endpoints[agsClaim]["lineitem"]; ok {
+			t.Error("context kept the lineitem of a resource link")
+		}
+	})
+	t.Run("deleted with the consumer", func(t *testing.T) {
+		api.deleteLaunchContexts(provider, b.Id)
+		if _, err := api.findLaunchContext(provider, &lti.ProviderServiceRequest{ResourceLinkId: "link2"}); err == nil {
+			t.Error("link of deleted consumer found")
+		}
+		if ids := index(api.st, launchContextIndex("link", provider, "link1")); !equalStrings(ids, []string{a.Id}) {
+			t.Errorf("link index %v, want %v", ids, []string{a.Id})
+		}
+		if ids := index(api.st, launchContextIndex("link", provider, "link2")); ids != nil {
+			t.Errorf("empty link index kept %v", ids)
+		}
+	})
+	t.Run("expired context leaves the index", func(t *testing.T) {
+		api.st.Delete(launchContextKey("link", a.Id, "link1"))
+		if _, err := api.findLaunchContext(provider, &lti.ProviderServiceRequest{ResourceLinkId: "link1"}); err == nil {
+			t.Error("expired link found")
+		}
+		if ids := index(api.st, launchContextIndex("link", provider, "link1")); ids != nil {
+			t.Errorf("expired link still indexed %v", ids)
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package run
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rayuruno/ltirun/internal/check"
+	"github.com/rayuruno/ltirun/lti"
+)
+
+const (
+	ActionDisable = "disable"
+	ActionEnable  = "enable"
+	ActionRotate  = "rotate"
+	ActionApprove = "approve"
+
+	ActionApproveDeployment = "approve_deployment"
+	ActionRemoveDeployment  = "remove_deployment"
+	ActionDeploymentPolicy  = "deployment_policy"
+	ActionProfile           = "profile"
+)
+
+type ConsumerSummary struct {
+	Id            string   `json:"id"`
+	Issuer        string   `json:"issuer"`
+	ClientId      string   `json:"client_id"`
+	DeploymentIds []string `json:"deployment_ids"`
+	// PendingDeployments were launched from but are not approved yet
+	PendingDeployments []string `json:"pending_deployments,omitempty"`
+	DeploymentPolicy   string   `json:"deployment_policy,omitempty"`
+	Profile            string   `json:"profile"`
+	ProductFamily      string   `json:"product_family,omitempty"`
+	Disabled           bool     `json:"disabled"`
+	Pending            bool     `json:"pending"`
+	Deferred           bool     `json:"deferred"`
+}
+
+type ConsumerDetail struct {
+	ConsumerSummary
+	Platform     *lti.Platform       `json:"platform"`
+	Registration *lti.Registration   `json:"registration"`
+	Update       *RegistrationUpdate `json:"update,omitempty"`
+}
+
+type ConsumerAction struct {
+	Id               string `json:"id"`
+	Action           string `json:"action"`
+	DeploymentId     string `json:"deployment_id,omitempty"`
+	DeploymentPolicy string `json:"deployment_policy,omitempty"`
+	Profile          string `json:"profile,omitempty"`
+}
+
+func (c *Consumer) Summary() *ConsumerSummary {
+	s := &ConsumerSummary{
+		Id:            c.Id,
+		Issuer:        c.Platform.Issuer,
+		ProductFamily: c.Platform.ProductFamilyCode,
+		DeploymentIds: append([]string{}, c.DeploymentIds...),
+		Disabled:      c.Disabled,
+		Pending:       c.Pending,
+		Deferred:      c.Deferred,
+	}
+	s.PendingDeployments = c.PendingDeployments
+	s.DeploymentPolicy = c.DeploymentPolicy
+	s.Profile = c.profile().Name
+	if c.Tool != nil {
+		s.ClientId = c.Tool.ClientId
+	}
+	return s
+}
+
+func (c *Consumer) auditEntry(deploymentId string) *AuditEntry {
+	return &AuditEntry{
+		Issuer:        c.Platform.Issuer,
+		ProductFamily: c.Platform.ProductFamilyCode,
+		DeploymentId:  deploymentId,
+		ClientId:      c.Tool.ClientId,
+	}
+}
+func (c *Consumer) active() error {
+	if c.Disabled {
+		return fmt.Errorf("registration disabled")
+	}
+	if c.Pending {
+		return fmt.Errorf("registration pending provider domain verification")
+	}
+	if c.Deferred {
+		return fmt.Errorf("registration awaiting provider approval")
+	}
+	return nil
+}
+
+func (api *Api) ListConsumers(providerUri string) []*ConsumerSummary {
+	list := []*ConsumerSummary{}
+	for _, id := range index(api.st, consumersIndex(providerUri)) {
+		c, err := get[Consumer](api.st, id)
+		if err != nil {
+			continue
+		}
+		list = append(list, c.Summary())
+	}
+	return list
+}
+func (api *Api) GetConsumer(providerUri, id string) (*ConsumerDetail, error) {
+	c, err := api.providerConsumer(providerUri, id)
+	if err != nil {
+		return nil, err
+	}
+	d := &ConsumerDetail{
+		ConsumerSummary: *c.Summary(),
+		Platform:        c.Platform,
+		Registration:    c.Tool,
+	}
+	d.Update, _ = get[RegistrationUpdate](api.st, updateKey(id))
+	return d, nil
+}
+func (api *Api) UpdateConsumer(providerUri string, a *ConsumerAction) (*ConsumerSummary, error) {
+	c, err := api.providerConsumer(providerUri, a.Id)
+	if err != nil {
+		return nil, err
+	}
+	if a.Action == ActionRotate {
+		if err := api.ks.Rotate(c.Id); err != nil {
+			return nil, err
+		}
+		return c.Summary(), nil
+	}
+	c, err = api.updateConsumer(c.Id, func(c *Consumer) error {
+		switch a.Action {
+		case ActionDisable:
+			c.Disabled = true
+		case ActionEnable:
+			c.Disabled = false
+		case ActionApprove:
+			c.Deferred = false
+		case ActionApproveDeployment:
+			if a.DeploymentId == "" {
+				return fmt.Errorf("deployment_id required")
+			}
+			if !check.ContainsAny(c.DeploymentIds, a.DeploymentId) {
+				c.DeploymentIds = append(c.DeploymentIds, a.DeploymentId)
+			}
+			c.PendingDeployments = without(c.PendingDeployments, a.DeploymentId)
+		case ActionRemoveDeployment:
+			c.DeploymentIds = without(c.DeploymentIds, a.DeploymentId)
+			c.PendingDeployments = without(c.PendingDeployments, a.DeploymentId)
+		case ActionDeploymentPolicy:
+			if err := checkDeploymentPolicy(a.DeploymentPolicy); err != nil {
+				return err
+			}
+			c.DeploymentPolicy = a.DeploymentPolicy
+		case ActionProfile:
+			if err := checkProfile(a.Profile); err != nil {
+				return err
+			}
+			c.Profile = a.Profile
+		default:
+			return fmt.Errorf("unknown action %q", a.Action)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.Summary(), nil
+}
+func (api *Api) DeleteConsumer(providerUri, id string) error {
+	c, err := api.providerConsumer(providerUri, id)
+	if err != nil {
+		return err
+	}
+	if err := api.st.Delete(c.Id); err != nil {
+		return err
+	}
+	api.st.Delete(updateKey(c.Id))
+	api.deleteLaunchContexts(providerUri, c.Id)
+	api.deleteOutboxItems(c.Id)
+	if keys, err := api.st.Keys(tokenKey(c.Id, "")); err == nil {
+		for _, k := range keys {
+			api.st.Delete(k)
+		}
+	}
+	api.ks.Rotate(c.Id)
+	return api.unindexConsumer(providerUri, c)
+}
+
+// updateConsumer applies fn to the stored consumer under the lock, concurrent launches,
+// registrations and provider actions don't overwrite each other's changes.
+func (api *Api) updateConsumer(id string, fn func(c *Consumer) error) (*Consumer, error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	c, err := get[Consumer](api.st, id)
+	if err != nil {
+		return nil, fmt.Errorf("unknown registration %s", id)
+	}
+	if err := fn(c); err != nil {
+		return nil, err
+	}
+	return c, set(api.st, c.Id, c, 0)
+}
+
+// providerConsumer only returns consumers registered for the provider.
+func (api *Api) providerConsumer(providerUri, id string) (*Consumer, error) {
+	if !strings.HasPrefix(id, providerUri+" ") {
+		return nil, fmt.Errorf("unknown registration %s", id)
+	}
+	c, err := get[Consumer](api.st, id)
+	if err != nil {
+		return nil, fmt.Errorf("unknown registration %s", id)
+	}
+	return c, nil
+}
@@ -0,0 +1,233 @@
+package run
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rayuruno/ltirun/internal/check"
+	"github.com/rayuruno/ltirun/lti"
+)
+
+const (
+	agsClaim  = "https://purl.imsglobal.org/spec/lti-ags/claim/endpoint"
+	nrpsClaim = "https://purl.imsglobal.org/spec/lti-nrps/claim/namesroleservice"
+	gsClaim   = "https://purl.imsglobal.org/spec/lti-gs/claim/groupsservice"
+
+	scopeLineItem         = "https://purl.imsglobal.org/spec/lti-ags/scope/lineitem"
+	scopeLineItemReadonly = "https://purl.imsglobal.org/spec/lti-ags/scope/lineitem.readonly"
+	scopeResult           = "https://purl.imsglobal.org/spec/lti-ags/scope/result"
+	scopeResultReadonly   = "https://purl.imsglobal.org/spec/lti-ags/scope/result.readonly"
+	scopeScore            = "https://purl.imsglobal.org/spec/lti-ags/scope/score"
+	scopeMembership       = "https://purl.imsglobal.org/spec/lti-nrps/scope/contextmembership.readonly"
+	scopeGroups           = "https://purl.imsglobal.org/spec/lti-gs/scope/contextgroup.readonly"
+
+	scopeRegistrationReadonly = "https://purl.imsglobal.org/spec/lti-reg/scope/registration.readonly"
+	scopeToolSetting          = "https://purl.imsglobal.org/spec/lti-ts/scope/toolsetting"
+)
+
+// allowedScopes may be requested by providers, including the read only variants.
+var allowedScopes = []string{
+	"openid",
+	scopeLineItem,
+	scopeLineItemReadonly,
+	scopeResult,
+	scopeResultReadonly,
+	scopeScore,
+	scopeMembership,
+	scopeGroups,
+	scopeRegistration,
+	scopeRegistrationReadonly,
+	scopeToolSetting,
+}
+
+// servicePermission allows one method on an endpoint advertised in the launch claims.
+type servicePermission struct {
+	scopes      []string
+	method      string
+	claim       string
+	field       string
+	suffix      string
+	nested      bool
+	contentType string
+	accept      string
+}
+
+var servicePermissions = []servicePermission{
+	{scopes: []string{scopeScore}, method: http.MethodPost, claim: agsClaim, field: "lineitem", suffix: "/scores", contentType: "application/vnd.ims.lis.v1.score+json"},
+	{scopes: []string{scopeResult, scopeResultReadonly}, method: http.MethodGet, claim: agsClaim, field: "lineitem", suffix: "/results", accept: "application/vnd.ims.lis.v2.resultcontainer+json"},
+	{scopes: []string{scopeLineItem, scopeLineItemReadonly}, method: http.MethodGet, claim: agsClaim, field: "lineitem", accept: "application/vnd.ims.lis.v2.lineitem+json"},
+	{scopes: []string{scopeLineItem}, method: http.MethodPut, claim: agsClaim, field: "lineitem", contentType: "application/vnd.ims.lis.v2.lineitem+json", accept: "application/vnd.ims.lis.v2.lineitem+json"},
+	{scopes: []string{scopeLineItem}, method: http.MethodDelete, claim: agsClaim, field: "lineitem"},
+	{scopes: []string{scopeLineItem, scopeLineItemReadonly}, method: http.MethodGet, claim: agsClaim, field: "lineitems", accept: "application/vnd.ims.lis.v2.lineitemcontainer+json"},
+	{scopes: []string{scopeLineItem}, method: http.MethodPost, claim: agsClaim, field: "lineitems", contentType: "application/vnd.ims.lis.v2.lineitem+json", accept: "application/vnd.ims.lis.v2.lineitem+json"},
+	{scopes: []string{scopeLineItem, scopeLineItemReadonly}, method: http.MethodGet, claim: agsClaim, field: "lineitems", nested: true, accept: "application/vnd.ims.lis.v2.lineitem+json"},
+	{scopes: []string{scopeLineItem}, method: http.MethodPut, claim: agsClaim, field: "lineitems", nested: true, contentType: "application/vnd.ims.lis.v2.lineitem+json", accept: "application/vnd.ims.lis.v2.lineitem+json"},
+	{scopes: []string{scopeLineItem}, method: http.MethodDelete, claim: agsClaim, field: "lineitems", nested: true},
+	{scopes: []string{scopeScore}, method: http.MethodPost, claim: agsClaim, field: "lineitems", nested: true, suffix: "/scores", contentType: "application/vnd.ims.lis.v1.score+json"},
+	{scopes: []string{scopeResult, scopeResultReadonly}, method: http.MethodGet, claim: agsClaim, field: "lineitems", nested: true, suffix: "/results", accept: "application/vnd.ims.lis.v2.resultcontainer+json"},
+	{scopes: []string{scopeMembership}, method: http.MethodGet, claim: nrpsClaim, field: "context_memberships_url", accept: "application/vnd.ims.lti-nrps.v2.membershipcontainer+json"},
+	{scopes: []string{scopeGroups}, method: http.MethodGet, claim: gsClaim, field: "context_groups_url", accept: "application/vnd.ims.lti-gs.v1.contextgroupcontainer+json"},
+	{scopes: []string{scopeGroups}, method: http.MethodGet, claim: gsClaim, field: "context_group_sets_url", accept: "application/vnd.ims.lti-gs.v1.contextgroupsetcontainer+json"},
+}
+
+// CheckServiceRequest limits service requests to the endpoints, scopes and media types the launch granted.
+func (api *Api) CheckServiceRequest(s *Session, r *lti.ServiceRequest) error {
+	requested := strings.Fields(r.Scope)
+	if len(requested) == 0 {
+		return fmt.Errorf("scope required")
+	}
+	granted := grantedScopes(s.Claims)
+	for _, scope := range requested {
+		if !check.ContainsAny(granted, scope) {
+			return fmt.Errorf("scope not granted %s", scope)
+		}
+	}
+	target, err := url.Parse(r.Endpoint)
+	if err != nil {
+		return err
+	}
+	method := strings.ToUpper(r.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	r.Method = method
+	for _, p := range servicePermissions {
+		if p.method != method || !check.ContainsAny(requested, p.scopes...) {
+			continue
+		}
+		base, _ := claimMap(s.Claims, p.claim)[p.field].(string)
+		if base == "" || !matchEndpoint(target, base, p.suffix, p.nested) {
+			continue
+		}
+		if p.contentType != "" && !matchMediaType(r.ContentType, p.contentType) {
+			return fmt.Errorf("content type must be %s", p.contentType)
+		}
+		if p.accept != "" && r.Accept != "" && !matchMediaType(r.Accept, p.accept, "application/json", "*/*") {
+			return fmt.Errorf("accept must be %s", p.accept)
+		}
+		return nil
+	}
+	return fmt.Errorf("endpoint not allowed %s %s", method, r.Endpoint)
+}
+
+func grantedScopes(claims jwt.MapClaims) []string {
+	var scopes []string
+	for _, c := range []string{agsClaim, gsClaim} {
+		if ss, ok := claimMap(claims, c)["scope"].([]any); ok {
+			for _, s := range ss {
+				if s, ok := s.(string); ok {
+					scopes = append(scopes, s)
+				}
+			}
+		}
+	}
+	if _, ok := claims[nrpsClaim]; ok {
+		scopes = append(scopes, scopeMembership)
+	}
+	return scopes
+}
+
+func claimMap(claims jwt.MapClaims, name string) map[string]any {
+	m, _ := claims[name].(map[string]any)
+	return m
+}
+
+// matchEndpoint compares scheme, host and path, a nested endpoint is exactly one segment below
+// the advertised path. The query may only repeat the advertised one and add paging and filters.
+func matchEndpoint(target *url.URL, base, suffix string, nested bool) bool {
+	baseUrl, err := url.Parse(base)
+	if err != nil {
+		return false
+	}
+	if target.Scheme != baseUrl.Scheme || target.Host != baseUrl.Host || target.User != nil || target.Fragment != "" {
+		return false
+	}
+	if !matchQuery(target.Query(), baseUrl.Query()) {
+		return false
+	}
+	basePath := strings.TrimSuffix(baseUrl.Path, "/")
+	targetPath := strings.TrimSuffix(target.Path, "/")
+	if !nested {
+		return targetPath == basePath+suffix
+	}
+	segment, ok := strings.CutPrefix(targetPath, basePath+"/")
+	if !ok {
+		return false
+	}
+	segment, ok = strings.CutSuffix(segment, suffix)
+	return ok && segment != "" && segment != "." && segment != ".." && !strings.Contains(segment, "/")
+}
+
+// queryParams filter and page service results (AGS, NRPS and GS).
+var queryParams = []string{"limit", "page", "per_page", "since", "rlid", "role", "resource_link_id", "resource_id", "tag", "user_id"}
+
+func matchQuery(target, base url.Values) bool {
+	for k, vs := range target {
+		if bv, ok := base[k]; ok {
+			if len(vs) != len(bv) {
+				return false
+			}
+			for i := range vs {
+				if vs[i] != bv[i] {
+					return false
+				}
+			}
+			continue
+		}
+		if !check.ContainsAny(queryParams, k) {
+			return false
+		}
+	}
+	for k := range base {
+		if _, ok := target[k]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func matchMediaType(value string, allowed ...string) bool {
+	for _, v := range strings.Split(value, ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil {
+			return false
+		}
+		if !check.ContainsAny(allowed, mt) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectScope keeps the requested scopes in allowedScopes, openid is always requested and
+// nothing requested selects the default scope.
+func selectScope(requested []string) string {
+	if len(requested) == 0 {
+		return defaultScope
+	}
+	scopes := []string{"openid"}
+	for _, s := range requested {
+		if check.ContainsAny(allowedScopes, s) && !check.ContainsAny(scopes, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return strings.Join(scopes, " ")
+}
+
+// intersectScope keeps the scopes also in supported, an empty list supports any.
+func intersectScope(scope string, supported []string) string {
+	if len(supported) == 0 {
+		return scope
+	}
+	var scopes []string
+	for _, s := range strings.Fields(scope) {
+		if check.ContainsAny(supported, s) {
+			scopes = append(scopes, s)
+		}
+	}
+	return strings.Join(scopes, " ")
+}
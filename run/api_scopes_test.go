@@ -0,0 +1,191 @@
+package run
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rayuruno/ltirun/internal/check"
+	"github.com/rayuruno/ltirun/lti"
+)
+
+func TestMatchEndpoint(t *testing.T) {
+	const lineitems = "https://lms.example.com/api/lti/courses/1/line_items"
+	tests := []struct {
+		name   string
+		target string
+		base   string
+		suffix string
+		nested bool
+		want   bool
+	}{
+		{"exact", lineitems, lineitems, "", false, true},
+		{"trailing slash", lineitems + "/", lineitems, "", false, true},
+		{"suffix", lineitems + "/scores", lineitems, "/scores", false, true},
+		{"missing suffix", lineitems, lineitems, "/scores", false, false},
+		{"other host", "https://evil.example.com/api/lti/courses/1/line_items", lineitems, "", false, false},
+		{"other scheme", "http://lms.example.com/api/lti/courses/1/line_items", lineitems, "", false, false},
+		{"userinfo", "https://user@lms.example.com/api/lti/courses/1/line_items", lineitems, "", false, false},
+		{"fragment", lineitems + "#x", lineitems, "", false, false},
+		{"below not nested", lineitems + "/2", lineitems, "", false, false},
+		{"nested", lineitems + "/2", lineitems, "", true, true},
+		{"nested scores", lineitems + "/2/scores", lineitems, "/scores", true, true},
+		{"nested results", lineitems + "/2/results", lineitems, "/results", true, true},
+		{"nested base itself", lineitems, lineitems, "", true, false},
+		{"nested empty segment", lineitems + "//scores", lineitems, "/scores", true, false},
+		{"nested two segments", lineitems + "/2/other", lineitems, "", true, false},
+		{"nested deeper with suffix", lineitems + "/2/other/scores", lineitems, "/scores", true, false},
+		{"nested dot dot", lineitems + "/..", lineitems, "", true, false},
+		{"nested sibling prefix", lineitems + "_all/2", lineitems, "", true, false},
+		{"paging query", lineitems + "?limit=10", lineitems, "", false, true},
+		{"filter query", lineitems + "?resource_link_id=1&tag=x", lineitems, "", false, true},
+		{"unknown query", lineitems + "?redirect=https://evil.example.com", lineitems, "", false, false},
+		{"base query kept", lineitems + "/scores?type_id=2", lineitems + "?type_id=2", "/scores", false, true},
+		{"base query dropped", lineitems + "/scores", lineitems + "?type_id=2", "/scores", false, false},
+		{"base query changed", lineitems + "/scores?type_id=3", lineitems + "?type_id=2", "/scores", false, false},
+		{"base query repeated", lineitems + "/scores?type_id=2&type_id=3", lineitems + "?type_id=2", "/scores", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := url.Parse(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := matchEndpoint(target, tt.base, tt.suffix, tt.nested); got != tt.want {
+				t.Errorf("matchEndpoint(%s, %s, %q, %v) = %v, want %v", tt.target, tt.base, tt.suffix, tt.nested, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGrantedScopes(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		want   []string
+		not    []string
+	}{
+		{
+			name:   "ags",
+			claims: jwt.MapClaims{agsClaim: map[string]any{"scope": []any{scopeScore, scopeLineItemReadonly}}},
+			want:   []string{scopeScore, scopeLineItemReadonly},
+			not:    []string{scopeLineItem},
+		},
+		{
+			name:   "result readonly is not escalated",
+			claims: jwt.MapClaims{agsClaim: map[string]any{"scope": []any{scopeResultReadonly}}},
+			want:   []string{scopeResultReadonly},
+			not:    []string{scopeResult},
+		},
+		{
+			name:   "nrps",
+			claims: jwt.MapClaims{nrpsClaim: map[string]any{"context_memberships_url": "https://lms.example.com/members"}},
+			want:   []string{scopeMembership},
+		},
+		{
+			name:   "no services",
+			claims: jwt.MapClaims{},
+			not:    []string{scopeScore, scopeMembership},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := grantedScopes(tt.claims)
+			for _, s := range tt.want {
+				if !check.ContainsAny(got, s) {
+					t.Errorf("%s not granted in %v", s, got)
+				}
+			}
+			for _, s := range tt.not {
+				if check.ContainsAny(got, s) {
+					t.Errorf("%s granted in %v", s, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckServiceRequest(t *testing.T) {
+	const (
+		lineitems = "https://lms.example.com/api/lti/courses/1/line_items"
+		lineitem  = lineitems + "/2"
+	)
+	s := &Session{Claims: jwt.MapClaims{
+		agsClaim: map[string]any{
+			"scope":     []any{scopeScore, scopeLineItemReadonly, scopeResultReadonly},
+			"lineitems": lineitems,
+			"lineitem":  lineitem,
+		},
+	}}
+	tests := []struct {
+		name    string
+		r       lti.ServiceRequest
+		wantErr bool
+	}{
+		{"score", lti.ServiceRequest{Scope: scopeScore, Method: http.MethodPost, Endpoint: lineitem + "/scores", ContentType: "application/vnd.ims.lis.v1.score+json"}, false},
+		{"score wrong content type", lti.ServiceRequest{Scope: scopeScore, Method: http.MethodPost, Endpoint: lineitem + "/scores", ContentType: "text/plain"}, true},
+		{"results readonly", lti.ServiceRequest{Scope: scopeResultReadonly, Endpoint: lineitem + "/results"}, false},
+		{"result not granted", lti.ServiceRequest{Scope: scopeResult, Endpoint: lineitem + "/results"}, true},
+		{"lineitems readonly", lti.ServiceRequest{Scope: scopeLineItemReadonly, Endpoint: lineitems}, false},
+		{"lineitems readonly nested", lti.ServiceRequest{Scope: scopeLineItemReadonly, Endpoint: lineitems + "/3"}, false},
+		{"lineitems readonly write", lti.ServiceRequest{Scope: scopeLineItemReadonly, Method: http.MethodPost, Endpoint: lineitems, ContentType: "application/vnd.ims.lis.v2.lineitem+json"}, true},
+		{"lineitem not granted", lti.ServiceRequest{Scope: scopeLineItem, Method: http.MethodDelete, Endpoint: lineitem}, true},
+		{"deep path", lti.ServiceRequest{Scope: scopeLineItemReadonly, Endpoint: lineitems + "/3/anything/else"}, true},
+		{"other url", lti.ServiceRequest{Scope: scopeLineItemReadonly, Endpoint: "https://lms.example.com/api/v1/users"}, true},
+		{"no scope", lti.ServiceRequest{Endpoint: lineitems}, true},
+	}
+	api := New(newMemStore(), nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.r
+			if err := api.CheckServiceRequest(s, &r); (err != nil) != tt.wantErr {
+				t.Errorf("CheckServiceRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSelectScope(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested []string
+		want      string
+	}{
+		{"nothing requested", nil, defaultScope},
+		{"read only", []string{scopeLineItemReadonly, scopeResultReadonly}, "openid " + scopeLineItemReadonly + " " + scopeResultReadonly},
+		{"openid once", []string{"openid", scopeScore}, "openid " + scopeScore},
+		{"duplicates", []string{scopeScore, scopeScore}, "openid " + scopeScore},
+		{"unknown dropped", []string{"https://example.com/scope/admin", scopeMembership}, "openid " + scopeMembership},
+		{"only unknown", []string{"https://example.com/scope/admin"}, "openid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := selectScope(tt.requested); got != tt.want {
+				t.Errorf("selectScope(%v) = %q, want %q", tt.requested, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIntersectScope(t *testing.T) {
+	tests := []struct {
+		name      string
+		scope     string
+		supported []string
+		want      string
+	}{
+		{"nothing supported listed", "openid " + scopeScore, nil, "openid " + scopeScore},
+		{"unsupported dropped", "openid " + scopeScore + " " + scopeGroups, []string{"openid", scopeScore}, "openid " + scopeScore},
+		{"read only kept", "openid " + scopeLineItemReadonly, []string{"openid", scopeLineItem, scopeLineItemReadonly}, "openid " + scopeLineItemReadonly},
+		{"read only not widened", "openid " + scopeLineItemReadonly, []string{"openid", scopeLineItem}, "openid"},
+		{"empty", "", []string{"openid"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := intersectScope(tt.scope, tt.supported); got != tt.want {
+				t.Errorf("intersectScope(%q, %v) = %q, want %q", tt.scope, tt.supported, got, tt.want)
+			}
+		})
+	}
+}
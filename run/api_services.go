@@ -7,10 +7,14 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/carlmjohnson/requests"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/rayuruno/ltirun/internal/check"
 	"github.com/rayuruno/ltirun/lti"
 	"github.com/rs/zerolog/log"
 )
@@ -25,20 +29,52 @@ func (api *Api) GetSession(jwksUri, signed string) (*Session, error) {
 	}
 	claims := token.Claims.(jwt.MapClaims)
 	log.Debug().Any("claims", claims).Msg("GetSession")
-	s, err := get[Session](api.st, claims["sub"].(string))
+	sid, _ := claims[sessionClaim].(string)
+	if sid == "" {
+		sid, _ = claims["sub"].(string)
+	}
+	s, err := get[Session](api.st, sid)
 	if err != nil {
 		return nil, err
 	}
-	if hashid(s.Id) != claims["jti"].(string) {
+	if jti, _ := claims["jti"].(string); hashid(s.Id) != jti {
 		return nil, fmt.Errorf("Unauthorized")
 	}
 	return s, nil
 }
+
+// tokenClient bounds token requests, every caller waiting on the same token waits for it.
+var tokenClient = &http.Client{Timeout: time.Second * 30}
+
 func (api *Api) GetAccessToken(s *Session, r *lti.ServiceRequest, t *lti.AccessToken) error {
+	scope := normalizeScope(r.Scope)
+	k := tokenKey(s.Consumer.Id, hashid(scope))
+	v, err := api.fl.Do(k, func() (any, error) {
+		if a, err := get[lti.AccessToken](api.st, k); err == nil {
+			return a, nil
+		}
+		a := new(lti.AccessToken)
+		if err := api.fetchAccessToken(s, scope, a); err != nil {
+			return nil, err
+		}
+		if ttl := a.ExpiresAfter() - accessTokenMargin; ttl > 0 {
+			if err := set(api.st, k, a, ttl); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	})
+	if err != nil {
+		return err
+	}
+	*t = *v.(*lti.AccessToken)
+	return nil
+}
+func (api *Api) fetchAccessToken(s *Session, scope string, t *lti.AccessToken) error {
 	sig, err := api.ks.Sign(jwt.RegisteredClaims{
 		Issuer:    s.Consumer.Tool.Domain,
 		Subject:   s.Consumer.Tool.ClientId,
-		Audience:  jwt.ClaimStrings{s.Consumer.Platform.TokenEndpoint},
+		Audience:  jwt.ClaimStrings{s.Consumer.profile().tokenAudience(s.Consumer)},
 		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
 		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(time.Hour * 1)),
 		ID:        hashid(s.Id),
@@ -51,21 +87,21 @@ func (api *Api) GetAccessToken(s *Session, r *lti.ServiceRequest, t *lti.AccessT
 	v.Set("grant_type", "client_credentials")
 	v.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
 	v.Set("client_assertion", sig)
-	v.Set("scope", r.Scope)
+	v.Set("scope", scope)
 
-	res, err := http.PostForm(s.Consumer.Platform.TokenEndpoint, v)
+	res, err := tokenClient.PostForm(s.Consumer.Platform.TokenEndpoint, v)
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 	if res.StatusCode >= 400 {
-		defer res.Body.Close()
 		b, err := io.ReadAll(res.Body)
 		return fmt.Errorf("token request failed %s %s %s", res.Status, b, err)
 	}
 
 	return json.NewDecoder(res.Body).Decode(t)
 }
-func (api *Api) SendServiceRequest(a *lti.AccessToken, r *lti.ServiceRequest) error {
+func (api *Api) SendServiceRequest(a *lti.AccessToken, r *lti.ServiceRequest, b *string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*1)
 	defer cancel()
 
@@ -76,13 +112,125 @@ func (api *Api) SendServiceRequest(a *lti.AccessToken, r *lti.ServiceRequest) er
 		ContentType(r.ContentType).
 		Accept(r.Accept).
 		BodyBytes(r.Body).
+		ToString(b).
 		Fetch(ctx)
 }
+
+// SignJWT signs tool originated messages, only known message templates are accepted and
+// the registered claims are taken from the session.
 func (api *Api) SignJWT(s *Session, p []byte) (string, error) {
 	claims := make(jwt.MapClaims)
 	err := json.Unmarshal(p, &claims)
 	if err != nil {
-		return "", nil
+		return "", err
+	}
+	mtype, _ := claims[messageTypeClaim].(string)
+	tmpl, ok := messageTemplates[mtype]
+	if !ok {
+		return "", fmt.Errorf("unsupported message type %q", mtype)
+	}
+	if s.Claims[messageTypeClaim] != tmpl.request {
+		return "", fmt.Errorf("%s requires a %s launch", mtype, tmpl.request)
+	}
+	for k := range claims {
+		if check.ContainsAny(sessionClaims, k) {
+			delete(claims, k)
+			continue
+		}
+		if k != messageTypeClaim && !check.ContainsAny(tmpl.claims, k) && !check.ContainsAny(tmpl.forced, k) {
+			return "", fmt.Errorf("claim not allowed %s", k)
+		}
+	}
+	for _, k := range tmpl.forced {
+		delete(claims, k)
+		if v, ok := forcedClaim(s, k); ok {
+			claims[k] = v
+		}
+	}
+	now := time.Now().UTC()
+	claims["iss"] = s.Consumer.Tool.ClientId
+	claims["aud"] = s.Consumer.Platform.Issuer
+	claims["iat"] = jwt.NewNumericDate(now)
+	claims["exp"] = jwt.NewNumericDate(now.Add(time.Minute * 5))
+	claims["nonce"] = uuid.NewString()
+	claims[versionClaim] = "1.3.0"
+	claims[deploymentIdClaim] = s.Claims[deploymentIdClaim]
+	if v, ok := s.Claims[targetLinkUriClaim]; ok {
+		claims[targetLinkUriClaim] = v
 	}
 	return api.ks.Sign(claims, s.Consumer.Id)
 }
+
+const (
+	messageTypeClaim        = "https://purl.imsglobal.org/spec/lti/claim/message_type"
+	versionClaim            = "https://purl.imsglobal.org/spec/lti/claim/version"
+	deepLinkingSettingClaim = "https://purl.imsglobal.org/spec/lti-dl/claim/deep_linking_settings"
+	deepLinkingDataClaim    = "https://purl.imsglobal.org/spec/lti-dl/claim/data"
+	sessionDataClaim        = "https://purl.imsglobal.org/spec/lti-ap/claim/session_data"
+	attemptNumberClaim      = "https://purl.imsglobal.org/spec/lti-ap/claim/attempt_number"
+	targetLinkUriClaim      = "https://purl.imsglobal.org/spec/lti/claim/target_link_uri"
+)
+
+// sessionClaims are always taken from the session, values sent by the tool are dropped.
+var sessionClaims = []string{
+	"iss", "aud", "sub", "iat", "exp", "nbf", "jti", "nonce",
+	versionClaim, deploymentIdClaim, targetLinkUriClaim,
+}
+
+type messageTemplate struct {
+	// message type of the launch the message answers
+	request string
+	claims  []string
+	// claims copied from the launch
+	forced []string
+}
+
+var messageTemplates = map[string]messageTemplate{
+	"LtiDeepLinkingResponse": {
+		request: "LtiDeepLinkingRequest",
+		claims: []string{
+			"https://purl.imsglobal.org/spec/lti-dl/claim/content_items",
+			"https://purl.imsglobal.org/spec/lti-dl/claim/msg",
+			"https://purl.imsglobal.org/spec/lti-dl/claim/log",
+			"https://purl.imsglobal.org/spec/lti-dl/claim/errormsg",
+			"https://purl.imsglobal.org/spec/lti-dl/claim/errorlog",
+		},
+		forced: []string{deepLinkingDataClaim},
+	},
+	"LtiStartAssessment": {
+		request: "LtiStartProctoring",
+		claims: []string{
+			"https://purl.imsglobal.org/spec/lti-ap/claim/end_assessment_return",
+			"https://purl.imsglobal.org/spec/lti-ap/claim/verified_user",
+			"https://purl.imsglobal.org/spec/lti/claim/launch_presentation",
+		},
+		forced: []string{sessionDataClaim, attemptNumberClaim, resourceLinkClaim},
+	},
+}
+
+func forcedClaim(s *Session, k string) (any, bool) {
+	if k == deepLinkingDataClaim {
+		v, ok := claimMap(s.Claims, deepLinkingSettingClaim)["data"]
+		return v, ok
+	}
+	v, ok := s.Claims[k]
+	return v, ok
+}
+
+const accessTokenMargin = time.Minute * 1
+
+func normalizeScope(scope string) string {
+	fields := strings.Fields(scope)
+	sort.Strings(fields)
+	uniq := fields[:0]
+	for _, f := range fields {
+		if len(uniq) == 0 || f != uniq[len(uniq)-1] {
+			uniq = append(uniq, f)
+		}
+	}
+	return strings.Join(uniq, " ")
+}
+
+func tokenKey(consumerId, scopeHash string) string {
+	return "token " + consumerId + " " + scopeHash
+}
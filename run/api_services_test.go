@@ -0,0 +1,176 @@
+package run
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rayuruno/ltirun/lti"
+)
+
+func TestGetAccessToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresIn any
+		status    int
+		scopes    []string
+		parallel  int
+		wantHits  int32
+		wantErr   bool
+	}{
+		{"cached per scope", 3600, http.StatusOK, []string{"a b", "b a", "a  b a"}, 1, 1, false},
+		{"other scope", 3600, http.StatusOK, []string{"a", "b"}, 1, 2, false},
+		{"expires_in as string", "3600", http.StatusOK, []string{"a", "a"}, 1, 1, false},
+		{"shorter than the margin", 30, http.StatusOK, []string{"a", "a"}, 1, 2, false},
+		{"concurrent callers share a fetch", 3600, http.StatusOK, []string{"a"}, 8, 1, false},
+		{"failed request is not cached", 3600, http.StatusUnauthorized, []string{"a", "a"}, 1, 2, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				time.Sleep(time.Millisecond * 20)
+				if tt.status != http.StatusOK {
+					w.WriteHeader(tt.status)
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]any{
+					"access_token": "token " + r.FormValue("scope"),
+					"token_type":   "Bearer",
+					"expires_in":   tt.expiresIn,
+					"scope":        r.FormValue("scope"),
+				})
+			}))
+			defer srv.Close()
+
+			api := New(newMemStore(), new(fakeKeyStore))
+			s := &Session{Id: "session", Consumer: &Consumer{
+				Id:       "consumer",
+				Tool:     &lti.Registration{ClientId: "client", Tool: &lti.Tool{}},
+				Platform: &lti.Platform{TokenEndpoint: srv.URL},
+			}}
+			for _, scope := range tt.scopes {
+				var wg sync.WaitGroup
+				errs := make([]error, tt.parallel)
+				for n := 0; n < tt.parallel; n++ {
+					wg.Add(1)
+					go func(n int) {
+						defer wg.Done()
+						a := new(lti.AccessToken)
+						if errs[n] = api.GetAccessToken(s, &lti.ServiceRequest{Scope: scope}, a); errs[n] == nil && a.Token != "token "+normalizeScope(scope) {
+							t.Errorf("GetAccessToken(%q) = %s", scope, a.Token)
+						}
+					}(n)
+				}
+				wg.Wait()
+				for _, err := range errs {
+					if (err != nil) != tt.wantErr {
+						t.Fatalf("GetAccessToken(%q) error = %v, wantErr %v", scope, err, tt.wantErr)
+					}
+				}
+			}
+			if got := hits.Load(); got != tt.wantHits {
+				t.Errorf("token requests %d, want %d", got, tt.wantHits)
+			}
+		})
+	}
+}
+
+func TestSignJWT(t *testing.T) {
+	const contentItems = "https://purl.imsglobal.org/spec/lti-dl/claim/content_items"
+	deepLinking := map[string]any{
+		messageTypeClaim:        "LtiDeepLinkingRequest",
+		deploymentIdClaim:       "1",
+		deepLinkingSettingClaim: map[string]any{"data": "platform data"},
+	}
+	proctoring := map[string]any{
+		messageTypeClaim:   "LtiStartProctoring",
+		deploymentIdClaim:  "1",
+		sessionDataClaim:   "session data",
+		attemptNumberClaim: float64(2),
+		resourceLinkClaim:  map[string]any{"id": "link"},
+	}
+	tests := []struct {
+		name    string
+		session map[string]any
+		payload map[string]any
+		want    map[string]any
+		wantErr bool
+	}{
+		{
+			name:    "deep linking response",
+			session: deepLinking,
+			payload: map[string]any{messageTypeClaim: "LtiDeepLinkingResponse", contentItems: []any{}},
+			want: map[string]any{
+				"iss":                "client",
+				"aud":                "https://lms.example.com",
+				deploymentIdClaim:    "1",
+				deepLinkingDataClaim: "platform data",
+				contentItems:         []any{},
+			},
+		},
+		{
+			name:    "session claims are replaced",
+			session: deepLinking,
+			payload: map[string]any{messageTypeClaim: "LtiDeepLinkingResponse", "iss": "other", "sub": "admin", deploymentIdClaim: "2", deepLinkingDataClaim: "forged"},
+			want:    map[string]any{"iss": "client", "sub": nil, deploymentIdClaim: "1", deepLinkingDataClaim: "platform data"},
+		},
+		{
+			name:    "start assessment copies the launch",
+			session: proctoring,
+			payload: map[string]any{messageTypeClaim: "LtiStartAssessment", sessionDataClaim: "forged", attemptNumberClaim: 9},
+			want:    map[string]any{sessionDataClaim: "session data", attemptNumberClaim: float64(2), resourceLinkClaim: map[string]any{"id": "link"}},
+		},
+		{
+			name:    "unknown message type",
+			session: deepLinking,
+			payload: map[string]any{messageTypeClaim: "LtiResourceLinkRequest"},
+			wantErr: true,
+		},
+		{
+			name:    "answers another launch",
+			session: deepLinking,
+			payload: map[string]any{messageTypeClaim: "LtiStartAssessment"},
+			wantErr: true,
+		},
+		{
+			name:    "claim outside the template",
+			session: deepLinking,
+			payload: map[string]any{messageTypeClaim: "LtiDeepLinkingResponse", "https://purl.imsglobal.org/spec/lti/claim/roles": []any{"Administrator"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := New(newMemStore(), new(fakeKeyStore))
+			s := &Session{Claims: tt.session, Consumer: &Consumer{
+				Id:       "consumer",
+				Tool:     &lti.Registration{ClientId: "client"},
+				Platform: &lti.Platform{Issuer: "https://lms.example.com"},
+			}}
+			p, _ := json.Marshal(tt.payload)
+			signed, err := api.SignJWT(s, p)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SignJWT() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			claims := make(map[string]any)
+			if err := json.Unmarshal([]byte(signed), &claims); err != nil {
+				t.Fatal(err)
+			}
+			for k, want := range tt.want {
+				if got := claims[k]; !reflect.DeepEqual(got, want) {
+					t.Errorf("claim %s = %v, want %v", k, got, want)
+				}
+			}
+		})
+	}
+}
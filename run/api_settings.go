@@ -0,0 +1,112 @@
+package run
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/rayuruno/ltirun/lti"
+)
+
+// Settings are stored per provider and managed through the provider api.
+type Settings struct {
+	// Strict fails registration on any tool configuration error instead of falling back to defaults.
+	Strict bool `json:"strict"`
+	// ApprovalWebhook approves, rejects or defers new registrations.
+	ApprovalWebhook string `json:"approval_webhook,omitempty"`
+	// DeploymentPolicy is auto or approve (default) for deployment ids seen at launch.
+	DeploymentPolicy string `json:"deployment_policy,omitempty"`
+	// Policy restricts the platforms which may register and launch.
+	Policy *Policy `json:"policy,omitempty"`
+	// StatementKeys are the thumbprints of the keys allowed to sign the software_statement,
+	// when empty the first key seen is pinned.
+	StatementKeys []string `json:"statement_keys,omitempty"`
+}
+
+// ToolConfigReport describes how the provider's openid_configuration was loaded.
+type ToolConfigReport struct {
+	Url         string `json:"url"`
+	Status      int    `json:"status,omitempty"`
+	FetchError  string `json:"fetch_error,omitempty"`
+	DecodeError string `json:"decode_error,omitempty"`
+	ProxyError  string `json:"proxy_error,omitempty"`
+	// StatementError is set when the software_statement could not be verified
+	StatementError string     `json:"statement_error,omitempty"`
+	Signed         bool       `json:"signed"`
+	ExtensionError string     `json:"extension_error,omitempty"`
+	Extension      *Extension `json:"extension,omitempty"`
+	Stale          string     `json:"stale,omitempty"`
+	Strict         bool       `json:"strict"`
+	Tool           *lti.Tool  `json:"effective_config,omitempty"`
+}
+
+func (r *ToolConfigReport) Err() error {
+	for _, e := range []string{r.FetchError, r.DecodeError, r.StatementError, r.ExtensionError, r.ProxyError} {
+		if e != "" {
+			return fmt.Errorf("%s: %s", r.Url, e)
+		}
+	}
+	return nil
+}
+
+func (api *Api) GetSettings(providerUri string) *Settings {
+	s, err := get[Settings](api.st, settingsKey(providerUri))
+	if err != nil {
+		return new(Settings)
+	}
+	return s
+}
+func (api *Api) StoreSettings(providerUri string, s *Settings) error {
+	if err := checkDeploymentPolicy(s.DeploymentPolicy); err != nil {
+		return err
+	}
+	if s.Policy != nil {
+		if err := s.Policy.validate(); err != nil {
+			return err
+		}
+	}
+	if s.ApprovalWebhook != "" {
+		if err := checkProviderUrl(providerUri, s.ApprovalWebhook); err != nil {
+			return err
+		}
+	}
+	return set(api.st, settingsKey(providerUri), s, 0)
+}
+func (api *Api) DiagnoseToolConfig(serviceUrl, providerUri string) *ToolConfigReport {
+	return api.diagnoseToolConfig(serviceUrl, providerUri, new(lti.Tool))
+}
+func (api *Api) diagnoseToolConfig(serviceUrl, providerUri string, t *lti.Tool) *ToolConfigReport {
+	rep := &ToolConfigReport{
+		Url:    toolConfigUrl(providerUri),
+		Strict: api.GetSettings(providerUri).Strict,
+	}
+	doc, err := api.fetchToolConfigDoc(providerUri)
+	rep.Status = doc.Status
+	rep.Stale = doc.Stale
+	if err != nil {
+		rep.FetchError = err.Error()
+	} else if err := json.Unmarshal(doc.Body, t); err != nil {
+		rep.DecodeError = err.Error()
+		*t = lti.Tool{}
+	} else if t.SoftwareStatement != "" {
+		if err := api.verifySoftwareStatement(providerUri, t); err != nil {
+			rep.StatementError = err.Error()
+			*t = lti.Tool{}
+		} else {
+			rep.Signed = true
+		}
+	}
+	ed := api.parsedExtension(providerUri, doc, err)
+	rep.ExtensionError = ed.Error
+	rep.Extension = ed.Ext
+	if err := proxyToolConfig(serviceUrl, providerUri, t, ed.Ext); err != nil {
+		rep.ProxyError = err.Error()
+		return rep
+	}
+	stripStatement(t)
+	rep.Tool = t
+	return rep
+}
+
+func settingsKey(providerUri string) string {
+	return "settings " + providerUri
+}
@@ -0,0 +1,120 @@
+package run
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rayuruno/ltirun/internal/check"
+	"github.com/rayuruno/ltirun/lti"
+)
+
+// verifySoftwareStatement checks the provider's software_statement (RFC 7591) against its
+// jwks_uri, the signed name, logo, messages, custom parameters and claims replace the
+// unsigned ones. The jwks_uri comes from the same unsigned document, so the signing key is
+// pinned the first time a provider is seen, or set in the provider settings.
+func (api *Api) verifySoftwareStatement(providerUri string, t *lti.Tool) error {
+	provUrl, err := providerUrl(providerUri)
+	if err != nil {
+		return err
+	}
+	if t.JwksUri == "" {
+		return fmt.Errorf("software_statement requires jwks_uri")
+	}
+	if err := checkProviderUrl(providerUri, t.JwksUri); err != nil {
+		return err
+	}
+	token, thumbprint, err := api.ks.VerifyKey(t.SoftwareStatement, t.JwksUri)
+	if err != nil {
+		return fmt.Errorf("software_statement: %w", err)
+	}
+	if err := api.checkStatementKey(providerUri, thumbprint); err != nil {
+		return err
+	}
+	iss, err := token.Claims.GetIssuer()
+	if err != nil {
+		return err
+	}
+	if iss != providerUri && iss != provUrl.String() {
+		return fmt.Errorf("software_statement: invalid issuer %s", iss)
+	}
+	b, err := json.Marshal(token.Claims)
+	if err != nil {
+		return err
+	}
+	signed := new(lti.Tool)
+	if err := json.Unmarshal(b, signed); err != nil {
+		return fmt.Errorf("software_statement: %w", err)
+	}
+	t.ClientName = signed.ClientName
+	t.LogoUri = signed.LogoUri
+	t.Messages = signed.Messages
+	t.CustomParameters = signed.CustomParameters
+	t.Claims = signed.Claims
+	return nil
+}
+
+// checkStatementKey trusts the first key a provider signs with until the provider pins keys
+// in its settings.
+func (api *Api) checkStatementKey(providerUri, thumbprint string) error {
+	if pinned := api.GetSettings(providerUri).StatementKeys; len(pinned) > 0 {
+		if !check.ContainsAny(pinned, thumbprint) {
+			return fmt.Errorf("software_statement: key %s not pinned in settings", thumbprint)
+		}
+		return nil
+	}
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	k := statementKey(providerUri)
+	pinned, err := api.st.Get(k)
+	if err != nil {
+		return err
+	}
+	if len(pinned) == 0 {
+		return api.st.Set(k, s2b(thumbprint), 0)
+	}
+	if b2s(pinned) != thumbprint {
+		return fmt.Errorf("software_statement: key %s differs from the key first seen", thumbprint)
+	}
+	return nil
+}
+
+// matchesStatement reports if the proxied tool config still carries the signed values, under
+// RFC 7591 the statement overrides them at the platform.
+func matchesStatement(t *lti.Tool) bool {
+	token, _, err := jwt.NewParser().ParseUnverified(t.SoftwareStatement, jwt.MapClaims{})
+	if err != nil {
+		return false
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return false
+	}
+	proxied := make(map[string]any)
+	if err := json.Unmarshal(b, &proxied); err != nil {
+		return false
+	}
+	for k, v := range token.Claims.(jwt.MapClaims) {
+		if check.ContainsAny(registeredClaims, k) {
+			continue
+		}
+		if !reflect.DeepEqual(v, proxied[k]) {
+			return false
+		}
+	}
+	return true
+}
+
+// stripStatement drops a statement which would override the proxied values.
+func stripStatement(t *lti.Tool) {
+	if t.SoftwareStatement != "" && !matchesStatement(t) {
+		t.SoftwareStatement = ""
+	}
+}
+
+var registeredClaims = []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti"}
+
+func statementKey(providerUri string) string {
+	return "statement key " + providerUri
+}
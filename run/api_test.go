@@ -0,0 +1,85 @@
+package run
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// memStore behaves like the redis store, a missing key reads as nil without error.
+type memStore struct {
+	mu sync.Mutex
+	m  map[string][]byte
+}
+
+func newMemStore() *memStore {
+	return &memStore{m: make(map[string][]byte)}
+}
+func (s *memStore) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m[key], nil
+}
+func (s *memStore) Set(key string, val []byte, exp time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m[key] = append([]byte(nil), val...)
+	return nil
+}
+func (s *memStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, key)
+	return nil
+}
+func (s *memStore) Keys(prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.m {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+func (s *memStore) Reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m = make(map[string][]byte)
+	return nil
+}
+func (s *memStore) Close() error {
+	return nil
+}
+
+// fakeKeyStore "signs" by encoding the claims as json, Verify decodes them again.
+type fakeKeyStore struct {
+	rotated []string
+}
+
+func (*fakeKeyStore) Jwks(id string) ([]byte, error) {
+	return []byte(`{"keys":[]}`), nil
+}
+func (*fakeKeyStore) Sign(claims jwt.Claims, id string) (string, error) {
+	b, err := json.Marshal(claims)
+	return string(b), err
+}
+func (*fakeKeyStore) Verify(signed string, jwksUri string) (*jwt.Token, error) {
+	claims := make(jwt.MapClaims)
+	if err := json.Unmarshal([]byte(signed), &claims); err != nil {
+		return nil, err
+	}
+	return &jwt.Token{Claims: claims, Valid: true}, nil
+}
+func (ks *fakeKeyStore) VerifyKey(signed string, jwksUri string) (*jwt.Token, string, error) {
+	token, err := ks.Verify(signed, jwksUri)
+	return token, "test", err
+}
+func (ks *fakeKeyStore) Rotate(id string) error {
+	ks.rotated = append(ks.rotated, id)
+	return nil
+}
@@ -0,0 +1,189 @@
+package run
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/carlmjohnson/requests"
+	"github.com/rayuruno/ltirun/internal/check"
+	"github.com/rayuruno/ltirun/lti"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	UpdateUnchanged   = "unchanged"
+	UpdateUnsupported = "unsupported"
+	UpdateSent        = "updated"
+	UpdateFailed      = "failed"
+
+	scopeRegistration = "https://purl.imsglobal.org/spec/lti-reg/scope/registration"
+)
+
+// RegistrationUpdate is the result of pushing the provider's tool config to one platform.
+type RegistrationUpdate struct {
+	ConsumerId string    `json:"consumer_id"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	ConfigHash string    `json:"config_hash,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// UpdateRegistrations pushes the effective tool config to the registration_client_uri of
+// every platform registered for the provider. Scopes the admin kept at registration are preserved
+// unless the provider no longer requests them.
+func (api *Api) UpdateRegistrations(serviceUrl, providerUri string) ([]*RegistrationUpdate, error) {
+	v, err := api.fl.Do("update "+providerUri, func() (any, error) {
+		var updates []*RegistrationUpdate
+		for _, id := range index(api.st, consumersIndex(providerUri)) {
+			u := api.updateRegistration(serviceUrl, providerUri, id)
+			if err := set(api.st, updateKey(id), u, 0); err != nil {
+				return nil, err
+			}
+			updates = append(updates, u)
+		}
+		return updates, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]*RegistrationUpdate), nil
+}
+func (api *Api) RegistrationUpdates(providerUri string) []*RegistrationUpdate {
+	var updates []*RegistrationUpdate
+	for _, id := range index(api.st, consumersIndex(providerUri)) {
+		u, err := get[RegistrationUpdate](api.st, updateKey(id))
+		if err != nil {
+			u = &RegistrationUpdate{ConsumerId: id}
+		}
+		updates = append(updates, u)
+	}
+	return updates
+}
+func (api *Api) updateRegistration(serviceUrl, providerUri, id string) *RegistrationUpdate {
+	u := &RegistrationUpdate{ConsumerId: id, UpdatedAt: time.Now().UTC()}
+	c, err := get[Consumer](api.st, id)
+	if err != nil {
+		u.Status, u.Error = UpdateFailed, err.Error()
+		return u
+	}
+	t := new(lti.Tool)
+	if err := api.LoadToolConfig(serviceUrl, providerUri, t); err != nil {
+		u.Status, u.Error = UpdateFailed, err.Error()
+		return u
+	}
+	if c.Tool.Tool == nil || c.Tool.Domain != t.Domain {
+		u.Status, u.Error = UpdateUnsupported, "registered through another domain"
+		return u
+	}
+	t = c.registeredConfig(t)
+	u.ConfigHash = toolConfigHash(t)
+	switch {
+	case u.ConfigHash == c.ConfigHash:
+		u.Status = UpdateUnchanged
+		return u
+	case c.Tool.RegistrationClientUri == "" || !check.ContainsAny(c.Platform.ScopesSupported, scopeRegistration):
+		u.Status = UpdateUnsupported
+		return u
+	}
+	r, err := api.putToolConfig(c, t)
+	if err != nil {
+		u.Status, u.Error = UpdateFailed, err.Error()
+		return u
+	}
+	if r.ClientId == "" {
+		r.ClientId = c.Tool.ClientId
+	}
+	if r.RegistrationClientUri == "" {
+		r.RegistrationClientUri = c.Tool.RegistrationClientUri
+	}
+	c.Tool = r
+	c.ConfigHash = u.ConfigHash
+	if err := set(api.st, c.Id, c, 0); err != nil {
+		u.Status, u.Error = UpdateFailed, err.Error()
+		return u
+	}
+	u.Status = UpdateSent
+	return u
+}
+func (api *Api) putToolConfig(c *Consumer, t *lti.Tool) (*lti.Registration, error) {
+	a := new(lti.AccessToken)
+	err := api.GetAccessToken(&Session{Id: c.Id, Consumer: c}, &lti.ServiceRequest{Scope: scopeRegistration}, a)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*1)
+	defer cancel()
+
+	r := new(lti.Registration)
+	return r, requests.
+		URL(c.Tool.RegistrationClientUri).
+		Method(http.MethodPut).
+		Bearer(a.Token).
+		BodyJSON(&lti.Registration{Tool: t, ClientId: c.Tool.ClientId}).
+		ToJSON(r).
+		Fetch(ctx)
+}
+
+// detectToolConfigChange starts pushing updates when the provider's effective tool config changed.
+func (api *Api) detectToolConfigChange(serviceUrl, providerUri string, t *lti.Tool) {
+	k := "toolconfig hash " + serviceUrl + " " + providerUri
+	hash := toolConfigHash(t)
+	prev, err := api.st.Get(k)
+	if err != nil || b2s(prev) == hash {
+		return
+	}
+	if err := api.st.Set(k, []byte(hash), 0); err != nil {
+		return
+	}
+	if len(prev) == 0 {
+		return
+	}
+	go func() {
+		if _, err := api.UpdateRegistrations(serviceUrl, providerUri); err != nil {
+			log.Error().Err(err).Str("provider", providerUri).Msg("UpdateRegistrations")
+		}
+	}()
+}
+
+// registeredConfig applies the admin's selection at registration to the provider's tool config,
+// scopes are limited to the registered ones and deselected messages stay excluded.
+func (c *Consumer) registeredConfig(t *lti.Tool) *lti.Tool {
+	rt := *t
+	rt.DeploymentId = ""
+	if c.Tool != nil && c.Tool.Tool != nil && c.Tool.Scope != "" {
+		rt.Scope = intersectScope(c.Tool.Scope, strings.Fields(t.Scope))
+	}
+	rt.Messages = nil
+	for _, m := range t.Messages {
+		if !check.ContainsAny(c.ExcludedMessages, messageKey(m)) {
+			rt.Messages = append(rt.Messages, m)
+		}
+	}
+	stripStatement(&rt)
+	return &rt
+}
+
+// messageKey identifies a message across tool config changes.
+func messageKey(m lti.LtiMessage) string {
+	return m.Type + " " + m.Label
+}
+
+func toolConfigHash(t *lti.Tool) string {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return ""
+	}
+	return hashid(b2s(b))
+}
+
+func consumersIndex(providerUri string) string {
+	return "consumers " + providerUri
+}
+
+func updateKey(consumerId string) string {
+	return "update " + consumerId
+}
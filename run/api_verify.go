@@ -0,0 +1,64 @@
+package run
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/carlmjohnson/requests"
+	"github.com/rs/zerolog/log"
+)
+
+// DomainChallenge is the token the provider serves at ChallengeUrl to prove it controls the domain.
+func DomainChallenge(providerUri string) string {
+	return hashid("ltirun challenge " + providerUri)
+}
+func (api *Api) DomainVerified(providerUri string) bool {
+	b, err := api.st.Get(verifiedKey(providerUri))
+	return err == nil && len(b) > 0
+}
+
+// VerifyDomain checks the challenge and activates the registrations waiting for it.
+func (api *Api) VerifyDomain(providerUri string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	body := ""
+	err := requests.
+		URL(ChallengeUrl(providerUri)).
+		Method(http.MethodGet).
+		ToString(&body).
+		Fetch(ctx)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(body) != DomainChallenge(providerUri) {
+		return fmt.Errorf("challenge mismatch at %s", ChallengeUrl(providerUri))
+	}
+	if err := api.st.Set(verifiedKey(providerUri), []byte(time.Now().UTC().Format(time.RFC3339)), 0); err != nil {
+		return err
+	}
+	for _, id := range index(api.st, consumersIndex(providerUri)) {
+		c, err := get[Consumer](api.st, id)
+		if err != nil || !c.Pending {
+			continue
+		}
+		if _, err := api.updateConsumer(c.Id, func(c *Consumer) error {
+			c.Pending = false
+			return nil
+		}); err != nil {
+			log.Error().Err(err).Str("id", c.Id).Msg("VerifyDomain")
+		}
+	}
+	return nil
+}
+
+func ChallengeUrl(providerUri string) string {
+	return providerScheme(providerUri) + "://" + providerUri + "/.well-known/ltirun-challenge"
+}
+
+func verifiedKey(providerUri string) string {
+	return "verified " + providerUri
+}
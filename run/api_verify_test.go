@@ -0,0 +1,67 @@
+package run
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rayuruno/ltirun/lti"
+)
+
+func TestVerifyDomain(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		challenge   func(providerUri string) string
+		wantErr     bool
+		wantPending bool
+	}{
+		{"challenge served", http.StatusOK, DomainChallenge, false, false},
+		{"challenge with newline", http.StatusOK, func(p string) string { return DomainChallenge(p) + "\n" }, false, false},
+		{"challenge of another provider", http.StatusOK, func(p string) string { return DomainChallenge("other.example.com") }, true, true},
+		{"challenge missing", http.StatusNotFound, DomainChallenge, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var provider string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/.well-known/ltirun-challenge" {
+					http.NotFound(w, r)
+					return
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.challenge(provider)))
+			}))
+			defer srv.Close()
+			provider = strings.TrimPrefix(srv.URL, "http://")
+			DevProviders(provider)
+			defer DevProviders()
+
+			api := New(newMemStore(), nil)
+			var ids []string
+			for _, client := range []string{"client1", "client2"} {
+				c := &Consumer{
+					Id:       consumerId(provider, "https://lms.example.com", client),
+					Tool:     &lti.Registration{ClientId: client},
+					Platform: &lti.Platform{Issuer: "https://lms.example.com"},
+					Pending:  true,
+				}
+				set(api.st, c.Id, c, 0)
+				api.indexConsumer(provider, c)
+				ids = append(ids, c.Id)
+			}
+			if err := api.VerifyDomain(provider); (err != nil) != tt.wantErr {
+				t.Fatalf("VerifyDomain() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if verified := api.DomainVerified(provider); verified == tt.wantErr {
+				t.Errorf("DomainVerified() = %v, want %v", verified, !tt.wantErr)
+			}
+			for _, id := range ids {
+				if c, _ := get[Consumer](api.st, id); c.Pending != tt.wantPending {
+					t.Errorf("%s pending %v, want %v", id, c.Pending, tt.wantPending)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package run
+
+import "strings"
+
+// devProviders may be served over http and from hosts without a dot.
+var devProviders []string
+
+// DevProviders enables development mode for the listed providers, e.g. localhost:3000.
+// It must be called before serving and never in production.
+func DevProviders(providers ...string) {
+	devProviders = providers
+}
+
+func isDevProvider(providerUri string) bool {
+	for _, p := range devProviders {
+		p = strings.TrimSuffix(p, "/")
+		if p != "" && (providerUri == p || strings.HasPrefix(providerUri, p+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+func providerScheme(providerUri string) string {
+	if isDevProvider(providerUri) {
+		return "http"
+	}
+	return "https"
+}